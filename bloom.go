@@ -0,0 +1,112 @@
+package cache2go
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// 布隆过滤器,用来快速判断一个key"一定不存在"
+// 只能添加不能删除,删除过的key仍然可能被判断为存在,需要定期重建
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // bit数
+	k    uint64 // 哈希函数个数
+}
+
+// 按预计元素个数n和误判率p计算大小
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// 用双重哈希计算key的k个位置
+func (b *bloomFilter) positions(key interface{}, f func(pos uint64)) {
+	h := fnv.New64a()
+	writeHashable(h, key)
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	for i := uint64(0); i < b.k; i++ {
+		f((h1 + i*h2) % b.m)
+	}
+}
+
+func (b *bloomFilter) add(key interface{}) {
+	b.positions(key, func(pos uint64) {
+		b.bits[pos/64] |= 1 << (pos % 64)
+	})
+}
+
+func (b *bloomFilter) mightContain(key interface{}) bool {
+	r := true
+	b.positions(key, func(pos uint64) {
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			r = false
+		}
+	})
+	return r
+}
+
+// 开启布隆过滤器,按预计的key数量和误判率分配空间,table中已有的key会加入过滤器,之后Add的key都会加入过滤器
+// 注意:设置了loadData时,Value遇到过滤器判断一定不存在的key不查table也不调用loadData,直接返回ErrKeyNotFoundOrLoadable,
+// 也就是说从来没有缓存过的key不会再通过loadData读穿;需要读穿的key必须先用AddToBloomFilter加入过滤器(比如后端存储中所有的key)
+func (table *CacheTable) EnableBloomFilter(expectedItems int, fpRate float64) {
+	table.Lock()
+	defer table.Unlock()
+	table.bloom = newBloomFilter(expectedItems, fpRate)
+	for _, item := range table.allItems() {
+		table.bloom.add(item.key)
+	}
+}
+
+// 关闭布隆过滤器
+func (table *CacheTable) DisableBloomFilter() {
+	table.Lock()
+	defer table.Unlock()
+	table.bloom = nil
+}
+
+// 把keys加入布隆过滤器,一般是后端存储中存在、可以通过loadData加载的key
+func (table *CacheTable) AddToBloomFilter(keys ...interface{}) {
+	table.Lock()
+	defer table.Unlock()
+	if table.bloom == nil {
+		return
+	}
+	for _, key := range keys {
+		table.bloom.add(key)
+	}
+}
+
+// 用table中现有的key重建布隆过滤器,清除已删除的key带来的误判
+// 通过AddToBloomFilter加入的key也会被清除,需要重新加入
+func (table *CacheTable) RebuildBloomFilter() {
+	table.Lock()
+	defer table.Unlock()
+	if table.bloom == nil {
+		return
+	}
+	table.bloom = &bloomFilter{bits: make([]uint64, len(table.bloom.bits)), m: table.bloom.m, k: table.bloom.k}
+	for _, item := range table.allItems() {
+		table.bloom.add(item.key)
+	}
+}
+
+// 判断key是否可能存在,返回false时key一定不在过滤器中;没有开启布隆过滤器时总是返回true
+func (table *CacheTable) MightContain(key interface{}) bool {
+	table.RLock()
+	defer table.RUnlock()
+	return table.bloom == nil || table.bloom.mightContain(key)
+}
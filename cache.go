@@ -1,31 +1,239 @@
 package cache2go
 
-import "sync"
-
-var (
-	cache = make(map[string]*CacheTable)
-	mutex sync.RWMutex
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// 创建一个Cache
+// Namespace 一个独立的table注册表
+// 不同Namespace中同名的table互不影响,库代码可以用自己的Namespace避免和别人共享全局table
+type Namespace struct {
+	mutex  sync.RWMutex
+	tables map[string]*CacheTable
+	// 表名是否不区分大小写,开启时tables的key是小写的表名
+	caseInsensitive bool
+	// table数量上限,0表示不限制;超出时调用onMaxTables,Cache返回overflow
+	maxTables   int
+	onMaxTables func(table string)
+	overflow    *CacheTable
+
+	// 定时器,触发tableCheck清理长时间没有访问的table
+	janitor *time.Timer
+}
+
+// 包级别的Cache()使用的默认Namespace
+var defaultNamespace = NewNamespace()
+
+// 创建一个新的Namespace
+func NewNamespace() *Namespace {
+	return &Namespace{
+		tables: make(map[string]*CacheTable),
+	}
+}
+
+// 在默认Namespace中创建一个Cache
 func Cache(table string) *CacheTable {
-	mutex.RLock()
-	t, ok := cache[table]
-	mutex.RUnlock()
+	return defaultNamespace.Cache(table)
+}
+
+// 在ns中创建一个Cache
+// table数量达到SetMaxTables的上限时返回一个共享的、已经关闭的溢出table:写入返回ErrTableClosed,读取都是未命中
+func (ns *Namespace) Cache(table string) *CacheTable {
+	t, err := ns.CacheWithError(table)
+	if err != nil {
+		return ns.overflowTable()
+	}
+	return t
+}
+
+// 在默认Namespace中创建一个Cache,table数量达到上限时返回ErrTooManyTables
+func CacheWithError(table string) (*CacheTable, error) {
+	return defaultNamespace.CacheWithError(table)
+}
+
+// 在ns中创建一个Cache,table数量达到SetMaxTables的上限时调用上限回调并返回ErrTooManyTables
+func (ns *Namespace) CacheWithError(table string) (*CacheTable, error) {
+	ns.mutex.RLock()
+	t, ok := ns.tables[ns.registryKey(table)]
+	ns.mutex.RUnlock()
 
 	if !ok {
-		mutex.Lock()
+		ns.mutex.Lock()
 		// 下面两行为什么要再确认一次呢?
 		// 有个词叫Double check,是为了防止多个goroutine同时调用Cache()重复进行初始化
-		t, ok = cache[table]
+		t, ok = ns.tables[ns.registryKey(table)]
 		if !ok {
+			if ns.maxTables > 0 && len(ns.tables) >= ns.maxTables {
+				onMaxTables := ns.onMaxTables
+				ns.mutex.Unlock()
+				if onMaxTables != nil {
+					onMaxTables(table)
+				}
+				return nil, ErrTooManyTables
+			}
 			t = &CacheTable{
-				name:  table,
-				items: make(map[interface{}]*CacheItem),
+				name:      table,
+				items:     newMapStore(),
+				namespace: ns,
+				policy:    NewLRUPolicy(),
 			}
-			cache[table] = t
+			ns.tables[ns.registryKey(table)] = t
 		}
-		mutex.Unlock()
+		ns.mutex.Unlock()
+	}
+	t.touch()
+	return t, nil
+}
+
+// 设置默认Namespace中table数量的上限,n<=0表示不限制
+func SetMaxTables(n int) {
+	defaultNamespace.SetMaxTables(n)
+}
+
+// 设置ns中table数量的上限,n<=0表示不限制;防止代码bug不断创建新table耗尽内存
+// 已有的table不受影响,数量降到上限以下后可以继续创建
+func (ns *Namespace) SetMaxTables(n int) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	ns.maxTables = n
+}
+
+// 设置默认Namespace中table数量达到上限、拒绝创建table时的回调
+func SetOnMaxTables(f func(table string)) {
+	defaultNamespace.SetOnMaxTables(f)
+}
+
+// 设置ns中table数量达到上限、拒绝创建table时的回调,table是被拒绝的表名,f在释放锁之后调用
+func (ns *Namespace) SetOnMaxTables(f func(table string)) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	ns.onMaxTables = f
+}
+
+// 获取ns共享的溢出table,不登记在ns中
+func (ns *Namespace) overflowTable() *CacheTable {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if ns.overflow == nil {
+		ns.overflow = &CacheTable{
+			items:  newMapStore(),
+			policy: NewLRUPolicy(),
+			closed: true,
+		}
+	}
+	return ns.overflow
+}
+
+// 设置默认Namespace的表名是否不区分大小写,开启后Cache("Users")和Cache("users")是同一个table
+func SetCaseInsensitiveTableNames(enabled bool) {
+	defaultNamespace.SetCaseInsensitiveTableNames(enabled)
+}
+
+// 设置ns的表名是否不区分大小写,影响Cache、DeleteTable和Tables
+// 应该在创建table之前设置;已有的table会按新规则重新登记,开启时只差大小写的几个table只保留表名排序最靠前的一个,
+// 其余的从ns中注销(不会被清空,已经拿到的引用仍然可用)
+func (ns *Namespace) SetCaseInsensitiveTableNames(enabled bool) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	ns.caseInsensitive = enabled
+	names := make([]string, 0, len(ns.tables))
+	byName := make(map[string]*CacheTable, len(ns.tables))
+	for _, t := range ns.tables {
+		names = append(names, t.name)
+		byName[t.name] = t
+	}
+	sort.Strings(names)
+	ns.tables = make(map[string]*CacheTable, len(names))
+	for _, name := range names {
+		if _, ok := ns.tables[ns.registryKey(name)]; !ok {
+			ns.tables[ns.registryKey(name)] = byName[name]
+		}
+	}
+}
+
+// 表名在tables中对应的key,调用方需持有ns的锁
+func (ns *Namespace) registryKey(table string) string {
+	if ns.caseInsensitive {
+		return strings.ToLower(table)
+	}
+	return table
+}
+
+// 从默认Namespace中删除table
+func DeleteTable(table string) bool {
+	return defaultNamespace.DeleteTable(table)
+}
+
+// 从ns中注销并关闭table,table不存在时返回false
+func (ns *Namespace) DeleteTable(table string) bool {
+	ns.mutex.RLock()
+	t, ok := ns.tables[ns.registryKey(table)]
+	ns.mutex.RUnlock()
+	if ok {
+		t.Close()
+	}
+	return ok
+}
+
+// 把t从ns中注销,同名的位置已经被别的table占用时不做处理
+func (ns *Namespace) deregister(t *CacheTable) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if ns.tables[ns.registryKey(t.name)] == t {
+		delete(ns.tables, ns.registryKey(t.name))
+	}
+}
+
+// 获取默认Namespace中所有table的表名
+func Tables() []string {
+	return defaultNamespace.Tables()
+}
+
+// 获取ns中所有table的表名,按字母序排列
+func (ns *Namespace) Tables() []string {
+	ns.mutex.RLock()
+	defer ns.mutex.RUnlock()
+	r := make([]string, 0, len(ns.tables))
+	for _, t := range ns.tables {
+		r = append(r, t.name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// 由定时器触发的table空闲检查,逻辑和CacheTable.expirationCheck类似
+// 注销并关闭空闲时间超过tableTTL的table,再按最快要到期的table设置下次检查的时间
+func (ns *Namespace) tableCheck() {
+	ns.mutex.Lock()
+	if ns.janitor != nil {
+		ns.janitor.Stop()
+	}
+	now := time.Now()
+	smallestDuration := 0 * time.Second
+	var expired []*CacheTable
+	for name, t := range ns.tables {
+		ttl := time.Duration(atomic.LoadInt64(&t.tableTTL))
+		if ttl <= 0 {
+			continue
+		}
+		idle := now.Sub(monoBase) - time.Duration(atomic.LoadInt64(&t.lastAccess))
+		if idle >= ttl {
+			delete(ns.tables, name)
+			expired = append(expired, t)
+		} else if smallestDuration == 0 || ttl-idle < smallestDuration {
+			smallestDuration = ttl - idle
+		}
+	}
+	if smallestDuration > 0 {
+		ns.janitor = time.AfterFunc(smallestDuration, ns.tableCheck)
+	}
+	ns.mutex.Unlock()
+
+	// 已经从注册表中移除了,不持有ns的锁关闭table
+	for _, t := range expired {
+		t.Close()
 	}
-	return t
 }
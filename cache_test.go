@@ -9,8 +9,16 @@ package cache2go
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"log"
+	"math"
+	"math/rand"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -472,3 +480,3372 @@ func TestLogger(t *testing.T) {
 		t.Error("Logger is empty")
 	}
 }
+
+func TestNamespace(t *testing.T) {
+	ns1 := NewNamespace()
+	ns2 := NewNamespace()
+
+	ns1.Cache("testNamespace").Add(k, 0, v)
+
+	// the same table name in another namespace must not share items
+	if ns2.Cache("testNamespace").Exists(k) {
+		t.Error("Namespaces with the same table name share items")
+	}
+	// nor with the default namespace
+	if Cache("testNamespace").Exists(k) {
+		t.Error("Namespace shares items with the default namespace")
+	}
+	if !ns1.Cache("testNamespace").Exists(k) {
+		t.Error("Error retrieving table from namespace")
+	}
+}
+
+func TestCacheTTLandTTI(t *testing.T) {
+	table := Cache("testTTLandTTI")
+	table.AddWithTTLandTTI(k, v, 300*time.Millisecond, 150*time.Millisecond)
+
+	// keep accessing the item well within its idle limit
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := table.Value(k); err != nil {
+			t.Error("Item expired before its absolute TTL:", err)
+		}
+	}
+
+	// the item must still expire at its absolute TTL despite the accesses
+	time.Sleep(150 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Frequently accessed item outlived its absolute TTL")
+	}
+}
+
+func TestLockStats(t *testing.T) {
+	table := Cache("testLockStats")
+	table.SetLockProfiling(true)
+
+	// hold the lock while another goroutine tries to add an item
+	var wg sync.WaitGroup
+	table.Lock()
+	wg.Add(1)
+	go func() {
+		table.Add(k, 0, v)
+		wg.Done()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	table.Unlock()
+	wg.Wait()
+
+	s := table.LockStats()
+	if s.Acquisitions < 2 {
+		t.Error("Error counting lock acquisitions:", s.Acquisitions)
+	}
+	if s.Contended == 0 || s.WaitTime == 0 {
+		t.Error("Error recording lock contention", s.Contended, s.WaitTime)
+	}
+
+	// nothing is recorded with profiling switched off
+	table.SetLockProfiling(false)
+	table.Exists(k)
+	if table.LockStats().Acquisitions != s.Acquisitions {
+		t.Error("Lock acquisitions recorded with profiling disabled")
+	}
+}
+
+func TestAddAuto(t *testing.T) {
+	table := Cache("testAddAuto")
+
+	// identical data must produce the same key and dedup
+	i1 := table.AddAuto(v, 0, nil)
+	i2 := table.AddAuto(v, 0, nil)
+	if i1 == nil || i2 == nil || i1.Key() != i2.Key() {
+		t.Error("Identical data produced different keys")
+	}
+	i3 := table.AddAuto(v+"_2", 0, nil)
+	if i3 == nil || i3.Key() == i1.Key() {
+		t.Error("Different data produced the same key")
+	}
+	if table.Count() != 2 {
+		t.Error("Error deduplicating identical data")
+	}
+
+	// a custom key function is used as-is
+	i4 := table.AddAuto(v, 0, func(data interface{}) interface{} {
+		return "custom_" + data.(string)
+	})
+	if i4.Key() != "custom_"+v || !table.Exists("custom_"+v) {
+		t.Error("Error using custom key function")
+	}
+}
+
+func TestApproxCount(t *testing.T) {
+	table := Cache("testApproxCount")
+	if !table.IsEmpty() || table.ApproxCount() != 0 {
+		t.Error("Error verifying empty table")
+	}
+
+	table.Add(k+"_1", 0, v)
+	table.Add(k+"_2", 0, v)
+	// overwriting an existing key must not change the count
+	table.Add(k+"_2", 0, v)
+	if table.IsEmpty() || table.ApproxCount() != 2 {
+		t.Error("Error tracking adds", table.ApproxCount())
+	}
+
+	table.Delete(k + "_1")
+	if table.ApproxCount() != 1 {
+		t.Error("Error tracking deletes", table.ApproxCount())
+	}
+	table.Delete(k + "_2")
+	if !table.IsEmpty() {
+		t.Error("Error verifying table is empty after deletes")
+	}
+
+	table.Add(k, 0, v)
+	table.Flush()
+	if !table.IsEmpty() {
+		t.Error("Error verifying table is empty after flush")
+	}
+}
+
+func TestFinalizer(t *testing.T) {
+	table := Cache("testFinalizer")
+	var deleted, expired, flushed, overwritten int32
+	count := func(c *int32) func(interface{}) {
+		return func(interface{}) { atomic.AddInt32(c, 1) }
+	}
+
+	if table.SetFinalizer(k, count(&deleted)) != ErrKeyNotFound {
+		t.Error("Expected error setting finalizer on missing key")
+	}
+
+	table.Add("delete", 0, v)
+	table.SetFinalizer("delete", count(&deleted))
+	table.Delete("delete")
+	table.Delete("delete")
+
+	table.Add("expire", 50*time.Millisecond, v)
+	table.SetFinalizer("expire", count(&expired))
+
+	table.Add("overwrite", 0, v)
+	table.SetFinalizer("overwrite", count(&overwritten))
+	table.Add("overwrite", 0, v)
+
+	time.Sleep(150 * time.Millisecond)
+
+	table.Add("flush", 0, v)
+	table.SetFinalizer("flush", count(&flushed))
+	table.Flush()
+	table.Flush()
+
+	time.Sleep(50 * time.Millisecond)
+	for name, c := range map[string]*int32{
+		"delete": &deleted, "expire": &expired, "flush": &flushed, "overwrite": &overwritten,
+	} {
+		if n := atomic.LoadInt32(c); n != 1 {
+			t.Errorf("Finalizer for %s ran %d times, expected once", name, n)
+		}
+	}
+}
+
+func TestIdleItems(t *testing.T) {
+	table := Cache("testIdleItems")
+	p := table.Add(k+"_1", 0, v)
+	table.Add(k+"_2", 0, v)
+
+	idle := p.IdleTime()
+	time.Sleep(100 * time.Millisecond)
+	if p.IdleTime() <= idle {
+		t.Error("IdleTime didn't grow")
+	}
+
+	// access one item, only the other one stays idle
+	table.Value(k + "_2")
+	items := table.IdleItems(50 * time.Millisecond)
+	if len(items) != 1 || items[0].Key() != k+"_1" {
+		t.Error("Error retrieving idle items")
+	}
+}
+
+func TestGraveyard(t *testing.T) {
+	table := Cache("testGraveyard")
+	table.SetGraveyard(2, 200*time.Millisecond)
+	table.Add(k, 50*time.Millisecond, v)
+	table.Add(k+"_deleted", 0, v)
+	table.Delete(k + "_deleted")
+
+	// the expired item moves into the graveyard, deleted ones don't
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Item didn't expire")
+	}
+	g := table.Graveyard()
+	if len(g) != 1 || g[0].Key() != k {
+		t.Error("Expired item not found in graveyard")
+	}
+
+	// and ages out after the graveyard's own ttl
+	time.Sleep(250 * time.Millisecond)
+	if len(table.Graveyard()) != 0 {
+		t.Error("Item didn't age out of graveyard")
+	}
+
+	// the graveyard is bounded by its capacity
+	for i := 0; i < 3; i++ {
+		table.Add(i, 10*time.Millisecond, v)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(table.Graveyard()) != 2 {
+		t.Error("Graveyard exceeded its capacity")
+	}
+}
+
+func TestValueOpts(t *testing.T) {
+	table := Cache("testValueOpts")
+	loads := 0
+	var loadArgs []interface{}
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		loads++
+		loadArgs = args
+		return NewCacheItem(key, 0, v)
+	})
+	table.Add(k, 0, v)
+
+	// NoTouch leaves the access stats alone
+	p, err := table.ValueOpts(k, NoTouch())
+	if err != nil || p.AccessCount() != 0 {
+		t.Error("NoTouch updated the access stats")
+	}
+	p, err = table.ValueOpts(k)
+	if err != nil || p.AccessCount() != 1 {
+		t.Error("Error touching item without options")
+	}
+
+	// NoLoad never invokes the loader, with or without NoTouch
+	if _, err = table.ValueOpts(k+"_1", NoLoad()); err != ErrKeyNotFound || loads != 0 {
+		t.Error("NoLoad invoked the loader")
+	}
+	if _, err = table.ValueOpts(k+"_1", NoLoad(), NoTouch()); err != ErrKeyNotFound || loads != 0 {
+		t.Error("NoLoad with NoTouch invoked the loader")
+	}
+
+	// WithArgs passes its arguments to the loader
+	if _, err = table.ValueOpts(k+"_2", WithArgs("a", "b")); err != nil || loads != 1 || len(loadArgs) != 2 {
+		t.Error("Error passing args to the loader")
+	}
+	if _, err = table.ValueOpts(k+"_3", NoTouch(), WithArgs("a")); err != nil || loads != 2 || len(loadArgs) != 1 {
+		t.Error("NoTouch prevented loading")
+	}
+}
+
+func TestGlobalStats(t *testing.T) {
+	t1 := Cache("testGlobalStats1")
+	t2 := Cache("testGlobalStats2")
+	t1.Add(k, 0, v)
+	t2.Add(k, 0, v)
+
+	t1.Value(k)
+	t1.Value(k)
+	t1.Value(k + "_missing")
+	t2.Value(k)
+	t2.Value(k + "_missing")
+	t2.Value(k + "_missing")
+
+	stats, total := GlobalStats()
+	if s := stats["testGlobalStats1"]; s.Hits != 2 || s.Misses != 1 || s.Items != 1 {
+		t.Error("Error retrieving table stats", s)
+	}
+	if s := stats["testGlobalStats2"]; s.Hits != 1 || s.Misses != 2 || s.Items != 1 {
+		t.Error("Error retrieving table stats", s)
+	}
+
+	// the aggregate covers every table in the registry, including these two
+	var hits, misses int64
+	for _, s := range stats {
+		hits += s.Hits
+		misses += s.Misses
+	}
+	if total.Hits != hits || total.Misses != misses || total.Hits < 3 || total.Misses < 3 {
+		t.Error("Error aggregating stats", total)
+	}
+}
+
+func TestBumpAccessCount(t *testing.T) {
+	table := Cache("testBumpAccessCount")
+	table.Add(k+"_1", time.Second, v)
+	p := table.Add(k+"_2", time.Second, v)
+	table.Value(k + "_1")
+
+	accessedOn := p.AccessedOn()
+	if err := table.BumpAccessCount(k+"_2", 5); err != nil {
+		t.Error("Error bumping access count", err)
+	}
+	ma := table.MostAccessed(2)
+	if len(ma) != 2 || ma[0].Key() != k+"_2" || p.AccessCount() != 5 {
+		t.Error("MostAccessed doesn't reflect the bumped access count")
+	}
+	// the deadline must not move
+	if !p.AccessedOn().Equal(accessedOn) {
+		t.Error("BumpAccessCount changed the access time")
+	}
+
+	if table.BumpAccessCount(k+"_3", 1) != ErrKeyNotFound {
+		t.Error("Expected error bumping missing key")
+	}
+}
+
+func TestTableTTL(t *testing.T) {
+	ns := NewNamespace()
+	table := ns.Cache("testTableTTL")
+	table.Add(k, 0, v)
+	table.SetTableTTL(100 * time.Millisecond)
+	ns.Cache("testTableNoTTL")
+
+	// accessing the table keeps it alive
+	time.Sleep(60 * time.Millisecond)
+	table.Value(k)
+	time.Sleep(60 * time.Millisecond)
+	if len(ns.Tables()) != 2 {
+		t.Error("Table removed although it was accessed")
+	}
+
+	// leaving it idle removes and flushes it
+	time.Sleep(100 * time.Millisecond)
+	tables := ns.Tables()
+	if len(tables) != 1 || tables[0] != "testTableNoTTL" {
+		t.Error("Idle table not removed from registry", tables)
+	}
+	if table.Count() != 0 {
+		t.Error("Idle table not flushed")
+	}
+}
+
+func TestWarm(t *testing.T) {
+	table := Cache("testWarm")
+	added := 0
+	table.AddAddedItemCallback(func(*CacheItem) { added++ })
+
+	table.Warm([]BatchEntry{
+		{Key: k + "_1", LifeSpan: 0, Data: v},
+		{Key: k + "_2", LifeSpan: 50 * time.Millisecond, Data: v},
+	})
+	if table.Count() != 2 || added != 0 {
+		t.Error("Error warming table", table.Count(), added)
+	}
+
+	// the cleanup schedule is still set up for warmed items
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k+"_2") || !table.Exists(k+"_1") {
+		t.Error("Error expiring warmed items")
+	}
+
+	// AddBatch fires the callbacks
+	table.AddBatch([]BatchEntry{{Key: k + "_3", Data: v}, {Key: k + "_4", Data: v}})
+	if added != 2 {
+		t.Error("AddBatch didn't fire added callbacks")
+	}
+}
+
+func TestWarmDependents(t *testing.T) {
+	table := NewNamespace().Cache("testWarmDependents")
+	table.Add("source", 0, v)
+	table.Add("derived", 0, v)
+	table.AddDependent("derived", "source")
+
+	// overwriting a key while warming invalidates its dependents like Add does
+	table.Warm([]BatchEntry{{Key: "source", Data: v + "_new"}})
+	if table.Exists("derived") {
+		t.Error("Dependent survived warming over its source")
+	}
+}
+
+func benchmarkEntries(n int) []BatchEntry {
+	entries := make([]BatchEntry, n)
+	for i := range entries {
+		entries[i] = BatchEntry{Key: i, LifeSpan: time.Hour, Data: v}
+	}
+	return entries
+}
+
+func BenchmarkAdd(b *testing.B) {
+	entries := benchmarkEntries(100000)
+	for n := 0; n < b.N; n++ {
+		table := NewNamespace().Cache("benchmarkAdd")
+		for _, e := range entries {
+			table.Add(e.Key, e.LifeSpan, e.Data)
+		}
+	}
+}
+
+func BenchmarkAddBatch(b *testing.B) {
+	entries := benchmarkEntries(100000)
+	for n := 0; n < b.N; n++ {
+		NewNamespace().Cache("benchmarkAddBatch").AddBatch(entries)
+	}
+}
+
+func BenchmarkWarm(b *testing.B) {
+	entries := benchmarkEntries(100000)
+	for n := 0; n < b.N; n++ {
+		NewNamespace().Cache("benchmarkWarm").Warm(entries)
+	}
+}
+
+func TestItemAccessorsRace(t *testing.T) {
+	// run with -race: the lock-free accessors only read immutable fields
+	table := Cache("testItemAccessorsRace")
+	p := table.Add(k, time.Second, v)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			table.Value(k)
+			table.BumpAccessCount(k, 1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if p.Key() != k || p.CreatedOn().IsZero() {
+				t.Error("Error reading immutable fields")
+			}
+			p.Data()
+			p.LifeSpan()
+			p.AccessedOn()
+			p.AccessCount()
+		}
+	}()
+	wg.Wait()
+}
+
+func TestDeleteOldest(t *testing.T) {
+	table := Cache("testDeleteOldest")
+	for i := 0; i < 5; i++ {
+		table.Add(i, 0, v)
+		time.Sleep(time.Millisecond)
+	}
+	deleted := 0
+	table.AddAboutToDeleteItemCallback(func(*CacheItem) { deleted++ })
+
+	if n := table.DeleteOldest(2); n != 2 || deleted != 2 {
+		t.Error("Error deleting oldest items", n, deleted)
+	}
+	if table.Exists(0) || table.Exists(1) || !table.Exists(2) {
+		t.Error("DeleteOldest removed the wrong items")
+	}
+	if n := table.DeleteOldest(10); n != 3 || table.Count() != 0 {
+		t.Error("Error deleting more items than available", n)
+	}
+}
+
+func TestDeleteLeastAccessed(t *testing.T) {
+	table := Cache("testDeleteLeastAccessed")
+	for i := 0; i < 5; i++ {
+		table.Add(i, 0, v)
+		for j := 0; j < i; j++ {
+			table.Value(i)
+		}
+	}
+
+	if n := table.DeleteLeastAccessed(3); n != 3 {
+		t.Error("Error deleting least accessed items", n)
+	}
+	if table.Count() != 2 || !table.Exists(3) || !table.Exists(4) {
+		t.Error("DeleteLeastAccessed removed the wrong items")
+	}
+}
+
+func TestKeyCollisionWarning(t *testing.T) {
+	out := new(bytes.Buffer)
+	table := Cache("testKeyCollisionWarning")
+	table.SetLogger(log.New(out, "", 0))
+	table.SetKeyCollisionWarning(true)
+
+	table.Add(int(1), 0, v)
+	table.Add(int(1), 0, v)
+	table.Add(int(2), 0, v)
+	if bytes.Contains(out.Bytes(), []byte("collides")) {
+		t.Error("Unexpected key collision warning", out.String())
+	}
+
+	table.Add(int64(1), 0, v)
+	if !bytes.Contains(out.Bytes(), []byte("Warning: key 1 (int64) collides with existing key 1 (int)")) {
+		t.Error("Key collision warning not logged", out.String())
+	}
+}
+
+func TestMostAccessedTies(t *testing.T) {
+	table := Cache("testMostAccessedTies")
+	for _, key := range []string{"e", "c", "a", "d", "b"} {
+		table.Add(key, 0, v)
+	}
+	table.Value("d")
+	table.Value("d")
+
+	// equal access counts are ordered by key, so the result is reproducible
+	for i := 0; i < 10; i++ {
+		ma := table.MostAccessed(3)
+		if len(ma) != 3 || ma[0].Key() != "d" || ma[1].Key() != "a" || ma[2].Key() != "b" {
+			t.Fatal("MostAccessed ties not broken by key")
+		}
+	}
+}
+
+func TestOnWrite(t *testing.T) {
+	table := Cache("testOnWrite")
+	errEmpty := errors.New("empty data")
+	table.SetOnWrite(func(key, data interface{}) (interface{}, error) {
+		s := data.(string)
+		if s == "" {
+			return nil, errEmpty
+		}
+		return strings.ToUpper(s), nil
+	})
+
+	// the transformed value is what gets cached
+	p := table.Add(k, 0, "value")
+	if p == nil || p.Data().(string) != "VALUE" {
+		t.Error("Error transforming data on write")
+	}
+	if p, err := table.Value(k); err != nil || p.Data().(string) != "VALUE" {
+		t.Error("Error retrieving transformed data")
+	}
+
+	// rejected data isn't stored and the error is passed through
+	if p := table.Add(k+"_empty", 0, ""); p != nil {
+		t.Error("Rejected item returned by Add")
+	}
+	if _, err := table.AddWithError(k+"_empty", 0, ""); err != errEmpty {
+		t.Error("Expected the validator's error, got", err)
+	}
+	if table.NotFoundAdd(k+"_empty", 0, "") || table.Exists(k+"_empty") {
+		t.Error("Rejected item stored in table")
+	}
+}
+
+func TestBatchExpireCallback(t *testing.T) {
+	var m sync.Mutex
+	var batches [][]*CacheItem
+	table := Cache("testBatchExpireCallback")
+	table.SetBatchExpireCallback(func(items []*CacheItem) {
+		m.Lock()
+		batches = append(batches, items)
+		m.Unlock()
+	})
+
+	table.Warm([]BatchEntry{
+		{Key: k + "_1", LifeSpan: 50 * time.Millisecond, Data: v},
+		{Key: k + "_2", LifeSpan: 50 * time.Millisecond, Data: v},
+		{Key: k + "_3", LifeSpan: 50 * time.Millisecond, Data: v},
+	})
+	time.Sleep(150 * time.Millisecond)
+
+	m.Lock()
+	defer m.Unlock()
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Error("Expired items not delivered in a single batch", len(batches))
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	table := Cache("testMaxAge")
+	table.SetMaxAge(200 * time.Millisecond)
+	table.Add(k, 150*time.Millisecond, v)
+
+	// keep the item alive within its sliding window
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := table.Value(k); err != nil {
+			t.Error("Item expired before max age:", err)
+		}
+	}
+
+	// it's removed at max age despite the constant access
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Item outlived the table's max age")
+	}
+}
+
+func TestRename(t *testing.T) {
+	table := Cache("testRename")
+	table.Add(k+"_1", 0, v+"_1")
+	table.Add(k+"_2", 0, v+"_2")
+	table.Add(k+"_3", 0, v+"_3")
+
+	if err := table.Rename(k+"_1", k+"_4"); err != nil || table.Exists(k+"_1") {
+		t.Error("Error renaming key", err)
+	}
+	if p, err := table.Value(k + "_4"); err != nil || p.Key() != k+"_4" || p.Data().(string) != v+"_1" {
+		t.Error("Error retrieving renamed item")
+	}
+	if table.Rename(k+"_2", k+"_3") != ErrKeyExists {
+		t.Error("Expected error renaming onto existing key")
+	}
+	if table.Rename(k+"_missing", k+"_5") != ErrKeyNotFound {
+		t.Error("Expected error renaming missing key")
+	}
+
+	// a "take source" resolver replaces the destination's data
+	err := table.RenameWith(k+"_2", k+"_3", func(dst, src *CacheItem) *CacheItem {
+		return src
+	})
+	if err != nil || table.Exists(k+"_2") || table.Count() != 2 {
+		t.Error("Error renaming onto existing key", err)
+	}
+	if p, err := table.Value(k + "_3"); err != nil || p.Data().(string) != v+"_2" {
+		t.Error("Destination doesn't hold the source's data")
+	}
+}
+
+func TestRenameRearmsHighWatermark(t *testing.T) {
+	table := NewNamespace().Cache("testRenameRearmsHighWatermark")
+	table.SetMaxItems(10)
+	var fired int32
+	table.SetOnHighWatermark(0.9, func(count, cap int) {
+		atomic.AddInt32(&fired, 1)
+	})
+	for i := 0; i < 9; i++ {
+		table.Add(i, 0, v)
+	}
+	// merging two items drops below the watermark and re-arms the alert
+	table.RenameWith(0, 1, func(dst, src *CacheItem) *CacheItem { return dst })
+	table.Add(9, 0, v)
+	if n := atomic.LoadInt32(&fired); n != 2 {
+		t.Error("Expected the watermark to fire again after a merge, got", n)
+	}
+}
+
+func TestRenameDependents(t *testing.T) {
+	table := NewNamespace().Cache("testRenameDependents")
+	table.Add("src", 0, v)
+	table.Add("dep", 0, v)
+	table.AddDependent("dep", "src")
+
+	// the dependency follows the renamed item
+	if err := table.Rename("src", "src2"); err != nil || !table.Exists("dep") {
+		t.Fatal("Error renaming source", err)
+	}
+	table.Delete("src2")
+	if table.Exists("dep") {
+		t.Error("Dependent survived deleting the renamed source")
+	}
+
+	// a replaced destination cascades to its dependents
+	table.Add("a", 0, v)
+	table.Add("dst", 0, v)
+	table.Add("dstDep", 0, v)
+	table.AddDependent("dstDep", "dst")
+	err := table.RenameWith("a", "dst", func(dst, src *CacheItem) *CacheItem {
+		return src
+	})
+	if err != nil || table.Exists("dstDep") {
+		t.Error("Dependent of the replaced destination wasn't deleted", err)
+	}
+
+	// recording a dependency is a write
+	table.Add("x", 0, v)
+	table.Add("y", 0, v)
+	table.Quiesce()
+	if err := table.AddDependent("x", "y"); err != ErrTableQuiesced {
+		t.Error("Expected ErrTableQuiesced adding a dependency to a quiesced table", err)
+	}
+}
+
+func TestDisableExpiration(t *testing.T) {
+	table := Cache("testDisableExpiration")
+	table.Add(k+"_1", 50*time.Millisecond, v)
+	table.DisableExpiration()
+	table.Add(k+"_2", 50*time.Millisecond, v)
+	table.AddWithTTLandTTI(k+"_3", v, 50*time.Millisecond, 50*time.Millisecond)
+
+	time.Sleep(150 * time.Millisecond)
+	if table.Count() != 3 {
+		t.Error("Items expired although expiration is disabled")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	table := Cache("testLookup")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+	table.Add(k, 0, v)
+
+	if p, ok := table.Lookup(k); !ok || p.Data().(string) != v || p.AccessCount() != 1 {
+		t.Error("Error looking up present key")
+	}
+	if p, ok := table.Lookup(k, NoTouch()); !ok || p.AccessCount() != 1 {
+		t.Error("Error looking up present key without touching it")
+	}
+	// absent keys are never loaded
+	if p, ok := table.Lookup(k + "_missing"); ok || p != nil || table.Exists(k+"_missing") {
+		t.Error("Error looking up absent key")
+	}
+}
+
+func TestDependents(t *testing.T) {
+	table := Cache("testDependents")
+	table.Add("source", 0, v)
+	table.Add("derived_1", 0, v)
+	table.Add("derived_2", 0, v)
+	table.Add("derived_of_derived", 0, v)
+	table.Add("unrelated", 0, v)
+
+	if table.AddDependent("derived_1", "source") != nil ||
+		table.AddDependent("derived_2", "source") != nil ||
+		table.AddDependent("derived_of_derived", "derived_1") != nil {
+		t.Error("Error adding dependents")
+	}
+	if table.AddDependent("source", "derived_of_derived") != ErrDependencyCycle {
+		t.Error("Expected error adding a dependency cycle")
+	}
+	if table.AddDependent("missing", "source") != ErrKeyNotFound {
+		t.Error("Expected error adding dependent for missing key")
+	}
+
+	// deleting the source cascades to its dependents, transitively
+	table.Delete("source")
+	if table.Exists("derived_1") || table.Exists("derived_2") || table.Exists("derived_of_derived") {
+		t.Error("Deleting source didn't cascade to its dependents")
+	}
+	if !table.Exists("unrelated") {
+		t.Error("Deleting source removed an unrelated item")
+	}
+
+	// updating a source cascades as well
+	table.Add("source", 0, v)
+	table.Add("derived_1", 0, v)
+	table.AddDependent("derived_1", "source")
+	table.Add("source", 0, v+"_2")
+	if table.Exists("derived_1") || !table.Exists("source") {
+		t.Error("Updating source didn't cascade to its dependents")
+	}
+}
+
+func TestSlowCleanup(t *testing.T) {
+	table := Cache("testSlowCleanup")
+	var m sync.Mutex
+	var slowTook time.Duration
+	table.SetSlowCleanupThreshold(20*time.Millisecond, func(took time.Duration) {
+		m.Lock()
+		slowTook = took
+		m.Unlock()
+	})
+	// make the sweep artificially slow
+	table.SetAboutToDeleteItemCallback(func(*CacheItem) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	table.Add(k, 10*time.Millisecond, v)
+	time.Sleep(150 * time.Millisecond)
+
+	s := table.Stats()
+	if s.LastCleanupDuration < 50*time.Millisecond || s.MaxCleanupDuration < s.LastCleanupDuration {
+		t.Error("Cleanup duration not recorded", s.LastCleanupDuration, s.MaxCleanupDuration)
+	}
+	m.Lock()
+	if slowTook < 50*time.Millisecond {
+		t.Error("Slow cleanup callback not fired", slowTook)
+	}
+	m.Unlock()
+}
+
+func TestReadOnly(t *testing.T) {
+	table := Cache("testReadOnly")
+	ro := table.ReadOnly()
+
+	// the view only offers read methods
+	var _ interface {
+		Value(key interface{}, args ...interface{}) (*CacheItem, error)
+		Peek(key interface{}) (*CacheItem, error)
+		Exists(key interface{}) bool
+		Count() int
+		Keys() []interface{}
+		Foreach(trans func(key interface{}, item *CacheItem))
+	} = ro
+	if _, ok := interface{}(ro).(interface {
+		Add(key interface{}, lifeSpan time.Duration, data interface{}) *CacheItem
+	}); ok {
+		t.Error("ReadOnlyTable exposes Add")
+	}
+
+	// reads reflect the live table
+	table.Add(k, 0, v)
+	if !ro.Exists(k) || ro.Count() != 1 || len(ro.Keys()) != 1 {
+		t.Error("Read-only view doesn't reflect the table")
+	}
+	if p, err := ro.Peek(k); err != nil || p.AccessCount() != 0 {
+		t.Error("Error peeking through read-only view")
+	}
+	if p, err := ro.Value(k); err != nil || p.Data().(string) != v {
+		t.Error("Error retrieving value through read-only view")
+	}
+	n := 0
+	ro.Foreach(func(key interface{}, item *CacheItem) { n++ })
+	table.Delete(k)
+	if n != 1 || ro.Exists(k) {
+		t.Error("Read-only view doesn't reflect the table")
+	}
+}
+
+func TestValueConcurrentDelete(t *testing.T) {
+	// run with -race: Value must never touch an item after it has been deleted
+	table := Cache("testValueConcurrentDelete")
+	type deletion struct {
+		item        *CacheItem
+		accessCount int64
+	}
+	var deleted []deletion
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			table.Add(k, 0, i)
+			if p, err := table.Delete(k); err == nil {
+				deleted = append(deleted, deletion{p, p.AccessCount()})
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			table.Value(k)
+		}
+	}
+
+	for _, d := range deleted {
+		if d.item.AccessCount() != d.accessCount {
+			t.Fatal("Value resurrected a deleted item")
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	table := Cache("testCSV")
+	table.Add(k+"_1", 0, v+"_1")
+	table.Add(k+"_2", 0, "comma, \"quoted\"\nnewline")
+	table.Add(1, 0, v)
+	table.Value(k + "_1")
+
+	buf := new(bytes.Buffer)
+	if err := table.ExportCSV(buf); err != nil {
+		t.Error("Error exporting CSV", err)
+	}
+
+	imported := Cache("testCSVImport")
+	if err := imported.ImportCSV(bytes.NewReader(buf.Bytes()), 0); err != nil {
+		t.Error("Error importing CSV", err)
+	}
+	if imported.Count() != 2 {
+		t.Error("Non-string entries not skipped", imported.Count())
+	}
+	for _, key := range []string{k + "_1", k + "_2"} {
+		orig, _ := table.Peek(key)
+		p, err := imported.Peek(key)
+		if err != nil || p.Data() != orig.Data() || !p.CreatedOn().Equal(orig.CreatedOn()) || p.AccessCount() != orig.AccessCount() {
+			t.Error("Error round-tripping entry through CSV", key)
+		}
+	}
+
+	// write errors are reported instead of silently dropping rows
+	quiesced := NewNamespace().Cache("testCSVQuiesced")
+	quiesced.Quiesce()
+	if err := quiesced.ImportCSV(bytes.NewReader(buf.Bytes()), 0); err != ErrTableQuiesced || quiesced.Count() != 0 {
+		t.Error("Expected ErrTableQuiesced importing into a quiesced table", err)
+	}
+	errRejected := errors.New("rejected")
+	rejecting := NewNamespace().Cache("testCSVRejected")
+	rejecting.SetOnWrite(func(key, data interface{}) (interface{}, error) {
+		if key == k+"_1" {
+			return nil, errRejected
+		}
+		return data, nil
+	})
+	if err := rejecting.ImportCSV(bytes.NewReader(buf.Bytes()), 0); err != errRejected || rejecting.Count() != 1 {
+		t.Error("Expected the rejection to be reported and other rows imported", err, rejecting.Count())
+	}
+
+	table.SetCSVStrict(true)
+	if table.ExportCSV(new(bytes.Buffer)) != ErrNotStringEntry {
+		t.Error("Expected error exporting non-string entry")
+	}
+}
+
+func TestLazyExpiration(t *testing.T) {
+	table := Cache("testLazyExpiration")
+	table.SetLazyExpiration(true)
+	table.Add(k+"_1", 50*time.Millisecond, v)
+	table.Add(k+"_2", 50*time.Millisecond, v)
+
+	table.RLock()
+	timer := table.cleanupTimer
+	table.RUnlock()
+	if timer != nil {
+		t.Error("Cleanup timer scheduled in lazy mode")
+	}
+
+	// expired items linger until they are accessed
+	time.Sleep(100 * time.Millisecond)
+	if table.Count() != 2 {
+		t.Error("Items swept in lazy mode")
+	}
+	if _, err := table.Value(k + "_1"); err != ErrKeyNotFound {
+		t.Error("Expired item returned in lazy mode")
+	}
+	if table.Exists(k + "_2") {
+		t.Error("Expired item reported as existing in lazy mode")
+	}
+	if table.Count() != 0 {
+		t.Error("Expired items not removed on access")
+	}
+}
+
+func TestHottestItems(t *testing.T) {
+	table := Cache("testHottestItems")
+	table.Add("old", 0, v)
+	for i := 0; i < 10; i++ {
+		table.Value("old")
+	}
+	time.Sleep(200 * time.Millisecond)
+	table.Add("recent", 0, v)
+	table.Value("recent")
+
+	// without recency weight the access count decides
+	if h := table.HottestItems(2, 0); len(h) != 2 || h[0].Key() != "old" {
+		t.Error("Error ranking by access count")
+	}
+	// with a high recency weight the recently accessed item wins
+	if h := table.HottestItems(1, 50); len(h) != 1 || h[0].Key() != "recent" {
+		t.Error("Error ranking by recency")
+	}
+}
+
+func TestUpdateIfFresh(t *testing.T) {
+	table := Cache("testUpdateIfFresh")
+	table.Add(k+"_short", 100*time.Millisecond, v)
+	table.Add(k+"_long", 10*time.Second, v)
+
+	if ok, err := table.UpdateIfFresh(k+"_short", v+"_new", time.Second); ok || err != nil {
+		t.Error("Updated item with little remaining life")
+	}
+	if ok, err := table.UpdateIfFresh(k+"_long", v+"_new", time.Second); !ok || err != nil {
+		t.Error("Didn't update item with ample remaining life")
+	}
+	if p, _ := table.Peek(k + "_short"); p.Data().(string) != v {
+		t.Error("Item with little remaining life was modified")
+	}
+	if p, _ := table.Peek(k + "_long"); p.Data().(string) != v+"_new" {
+		t.Error("Item with ample remaining life wasn't modified")
+	}
+	if _, err := table.UpdateIfFresh(k+"_missing", v, 0); err != ErrKeyNotFound {
+		t.Error("Expected error updating missing key")
+	}
+}
+
+func TestUpdateDependents(t *testing.T) {
+	table := NewNamespace().Cache("testUpdateDependents")
+	always := func(key interface{}, item *CacheItem) bool { return true }
+	updates := []func(key interface{}){
+		func(key interface{}) { table.UpdateValue(key, v+"_new") },
+		func(key interface{}) { table.UpdateIfFresh(key, v+"_new", 0) },
+		func(key interface{}) { table.UpdateBatchIf(map[interface{}]interface{}{key: v + "_new"}, always) },
+		func(key interface{}) { table.Modify(key, func(data interface{}) interface{} { return v + "_new" }) },
+	}
+	// replacing the data invalidates dependents just like overwriting the item
+	for i, update := range updates {
+		table.Add("source", 0, v)
+		table.Add("derived", 0, v)
+		table.AddDependent("derived", "source")
+		update("source")
+		if table.Exists("derived") {
+			t.Error("Dependent survived updating its source", i)
+		}
+	}
+}
+
+func TestSetAccessedOn(t *testing.T) {
+	table := Cache("testSetAccessedOn")
+	// restore an item that was last accessed 200ms ago with a 300ms lifespan
+	table.Add(k, 300*time.Millisecond, v)
+	if err := table.SetAccessedOn(k, time.Now().Add(-200*time.Millisecond)); err != nil {
+		t.Error("Error setting access time", err)
+	}
+
+	// it expires at the originally intended time, not 300ms from now
+	time.Sleep(50 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Item expired too early")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Item didn't expire at its original deadline")
+	}
+
+	if table.SetAccessedOn(k, time.Now()) != ErrKeyNotFound {
+		t.Error("Expected error setting access time of missing key")
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	out := new(bytes.Buffer)
+	table := Cache("testLogLevel")
+	table.SetLogger(log.New(out, "", 0))
+	table.SetLogLevel(LogInfo)
+
+	table.Add(k, 50*time.Millisecond, v)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := table.WaitEmpty(ctx); err != nil {
+		t.Fatal("Item did not expire:", err)
+	}
+
+	// expiration checks log at debug level, adds and deletes at info
+	if bytes.Contains(out.Bytes(), []byte("Expiration check")) {
+		t.Error("Debug level expiration lines not suppressed")
+	}
+	if !bytes.Contains(out.Bytes(), []byte("Adding item")) || !bytes.Contains(out.Bytes(), []byte("Deleting item")) {
+		t.Error("Info level lines missing", out.String())
+	}
+}
+
+func TestWaitEmpty(t *testing.T) {
+	table := Cache("testWaitEmpty")
+	table.Add(k+"_1", 0, v)
+	table.Add(k+"_2", 0, v)
+
+	result := make(chan error)
+	go func() {
+		result <- table.WaitEmpty(context.Background())
+	}()
+
+	table.Delete(k + "_1")
+	select {
+	case <-result:
+		t.Error("WaitEmpty returned before the table was empty")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	table.Delete(k + "_2")
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Error("Error waiting for empty table", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("WaitEmpty didn't return after the table was emptied")
+	}
+
+	// a canceled context stops the wait
+	table.Add(k, 0, v)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := table.WaitEmpty(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected context error, got", err)
+	}
+}
+
+func TestKeepAliveThrottle(t *testing.T) {
+	table := Cache("testKeepAliveThrottle")
+	table.SetKeepAliveThrottle(100 * time.Millisecond)
+	p := table.Add(k, 0, v)
+
+	// a burst of accesses is coalesced into one update
+	for i := 0; i < 10; i++ {
+		table.Value(k)
+	}
+	if p.AccessCount() != 1 {
+		t.Error("KeepAlive not throttled", p.AccessCount())
+	}
+	time.Sleep(150 * time.Millisecond)
+	table.Value(k)
+	if p.AccessCount() != 2 {
+		t.Error("KeepAlive not applied after the throttle interval", p.AccessCount())
+	}
+
+	table.SetKeepAliveThrottle(0)
+	table.Value(k)
+	table.Value(k)
+	if p.AccessCount() != 4 {
+		t.Error("KeepAlive still throttled after disabling", p.AccessCount())
+	}
+}
+
+func benchmarkHotKey(b *testing.B, throttle time.Duration) {
+	table := NewNamespace().Cache("benchmarkHotKey")
+	table.SetKeepAliveThrottle(throttle)
+	p := table.Add(k, 0, v)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			table.Value(k)
+		}
+	})
+	// every applied KeepAlive takes the item's write lock
+	b.ReportMetric(float64(p.AccessCount())/float64(b.N), "locks/op")
+}
+
+func BenchmarkHotKey(b *testing.B) {
+	benchmarkHotKey(b, 0)
+}
+
+func BenchmarkHotKeyThrottled(b *testing.B) {
+	benchmarkHotKey(b, time.Millisecond)
+}
+
+// countingStore counts the operations performed on the backing store
+type countingStore struct {
+	mapStore
+	gets, sets int
+}
+
+func (s *countingStore) Get(key interface{}) (*CacheItem, bool) {
+	s.gets++
+	return s.mapStore.Get(key)
+}
+
+func (s *countingStore) Set(key interface{}, item *CacheItem) {
+	s.sets++
+	s.mapStore.Set(key, item)
+}
+
+func TestItemStore(t *testing.T) {
+	table := Cache("testItemStore")
+	table.Add(k+"_1", 0, v)
+	store := &countingStore{mapStore: newMapStore()}
+	table.setStore(store)
+	if table.Count() != 1 || !table.Exists(k+"_1") {
+		t.Error("Existing items not copied into the new store")
+	}
+
+	table.Add(k+"_2", 0, v)
+	if store.sets != 2 {
+		t.Error("Store not exercised by Add", store.sets)
+	}
+	gets := store.gets
+	if _, err := table.Value(k + "_2"); err != nil || store.gets == gets {
+		t.Error("Store not exercised by Value")
+	}
+}
+
+type failingWriter struct{ panics bool }
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	if w.panics {
+		panic("writer closed")
+	}
+	return 0, errors.New("broken pipe")
+}
+
+func TestOnLogError(t *testing.T) {
+	for _, panics := range []bool{false, true} {
+		table := Cache("testOnLogError" + strconv.FormatBool(panics))
+		table.SetLogger(log.New(failingWriter{panics: panics}, "", 0))
+		var failures int32
+		table.SetOnLogError(func(err error) {
+			atomic.AddInt32(&failures, 1)
+		})
+
+		table.Add(k, 0, v)
+		if _, err := table.Value(k); err != nil {
+			t.Error("Cache operation failed with a broken logger", err)
+		}
+		if _, err := table.Delete(k); err != nil {
+			t.Error("Delete failed with a broken logger", err)
+		}
+		if atomic.LoadInt32(&failures) == 0 {
+			t.Error("Log errors not reported, panics:", panics)
+		}
+	}
+}
+
+func TestSetLoggerConcurrentLogging(t *testing.T) {
+	table := NewNamespace().Cache("testSetLoggerConcurrentLogging")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			table.SetLogger(log.New(io.Discard, "", 0))
+			table.SetOnLogError(func(error) {})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// AddAuto logs without holding the table lock when the data can't be encoded
+		for i := 0; i < 100; i++ {
+			table.AddAuto(func() {}, 0, nil)
+			table.AddChanged(k, 0, i)
+		}
+	}()
+	wg.Wait()
+}
+
+func TestChecksum(t *testing.T) {
+	table := Cache("testChecksum")
+	table.Add(k+"_1", 0, v)
+	table.Add(k+"_2", 0, []int{1, 2, 3})
+	sum := table.Checksum()
+	table.Value(k + "_1")
+	if table.Checksum() != sum {
+		t.Error("Checksum not stable for unchanged data")
+	}
+
+	table.Add(k+"_2", 0, []int{1, 2, 4})
+	if table.Checksum() == sum {
+		t.Error("Checksum didn't change after a mutation")
+	}
+	table.Add(k+"_2", 0, []int{1, 2, 3})
+	if table.Checksum() != sum {
+		t.Error("Checksum differs for the same logical contents")
+	}
+}
+
+func TestAddIdempotent(t *testing.T) {
+	table := Cache("testAddIdempotent")
+	first, added := table.AddIdempotent(k, 0, v, "op-1")
+	if !added || first == nil {
+		t.Fatal("Error adding item with a new operation id")
+	}
+	second, added := table.AddIdempotent(k, 0, v+"_retry", "op-1")
+	if added || second != first {
+		t.Error("Retried operation was not a no-op")
+	}
+	if p, err := table.Value(k); err != nil || p.Data().(string) != v {
+		t.Error("Retried operation overwrote the item")
+	}
+
+	if _, added := table.AddIdempotent(k, 0, v+"_new", "op-2"); !added {
+		t.Error("Distinct operation id was treated as a retry")
+	}
+
+	table.SetIdempotencyWindow(1, 0)
+	table.AddIdempotent(k+"_a", 0, v, "op-a")
+	table.AddIdempotent(k+"_b", 0, v, "op-b")
+	if _, added := table.AddIdempotent(k+"_a", 0, v, "op-a"); !added {
+		t.Error("Operation id not evicted from a full window")
+	}
+}
+
+func TestItemsCreatedAfter(t *testing.T) {
+	table := Cache("testItemsCreatedAfter")
+	table.Add(k+"_old", 0, v)
+	time.Sleep(10 * time.Millisecond)
+	checkpoint := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	table.Add(k+"_new_1", 0, v)
+	table.Add(k+"_new_2", 0, v)
+
+	items := table.ItemsCreatedAfter(checkpoint)
+	if len(items) != 2 || items[0].Key() != k+"_new_1" || items[1].Key() != k+"_new_2" {
+		t.Error("Error retrieving items created after the checkpoint", items)
+	}
+	for _, item := range items {
+		if item.AccessCount() != 0 {
+			t.Error("ItemsCreatedAfter touched access stats")
+		}
+	}
+}
+
+func TestDeferAddedCallbacks(t *testing.T) {
+	table := Cache("testDeferAddedCallbacks")
+	table.SetDeferAddedCallbacks(true)
+	returned := make(chan struct{})
+	observed := make(chan bool, 1)
+	table.SetAddedItemCallback(func(item *CacheItem) {
+		<-returned
+		observed <- table.Exists(item.Key())
+	})
+
+	table.Add(k, 0, v)
+	close(returned)
+	select {
+	case ok := <-observed:
+		if !ok {
+			t.Error("Deferred callback didn't observe the added item")
+		}
+	case <-time.After(time.Second):
+		t.Error("Deferred callback never ran")
+	}
+
+	var order []int
+	var mu sync.Mutex
+	done := make(chan struct{})
+	table.SetAddedItemCallback(func(item *CacheItem) {
+		mu.Lock()
+		order = append(order, item.Data().(int))
+		if len(order) == 10 {
+			close(done)
+		}
+		mu.Unlock()
+	})
+	for i := 0; i < 10; i++ {
+		table.Add(k+strconv.Itoa(i), 0, i)
+	}
+	<-done
+	for i, d := range order {
+		if d != i {
+			t.Error("Deferred callbacks ran out of order", order)
+			break
+		}
+	}
+}
+
+func TestEnsureValues(t *testing.T) {
+	table := Cache("testEnsureValues")
+	table.Add(k+"_1", 0, v)
+	var loads int32
+	release := make(chan struct{})
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		if key == k+"_missing" {
+			return nil
+		}
+		return NewCacheItem(key, 0, v)
+	})
+
+	keys := []interface{}{k + "_1", k + "_2", k + "_3", k + "_2", k + "_missing"}
+	var wg sync.WaitGroup
+	results := make([]map[interface{}]*CacheItem, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = table.EnsureValues(keys)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&loads); n != 3 {
+		t.Error("Loader not called exactly once per missing key", n)
+	}
+	for _, r := range results {
+		if len(r) != 3 || r[k+"_1"] == nil || r[k+"_2"] == nil || r[k+"_3"] == nil {
+			t.Error("Error ensuring values", r)
+		}
+	}
+	if !table.Exists(k+"_2") || !table.Exists(k+"_3") {
+		t.Error("Loaded values not cached")
+	}
+}
+
+func TestOnAccessCallback(t *testing.T) {
+	table := Cache("testOnAccessCallback")
+	watched := table.Add(k+"_1", 0, v)
+	table.Add(k+"_2", 0, v)
+	var calls int32
+	watched.SetOnAccessCallback(func(item *CacheItem) {
+		if item != watched {
+			t.Error("Access callback got the wrong item")
+		}
+		atomic.AddInt32(&calls, 1)
+	})
+
+	table.Value(k + "_2")
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Error("Access callback fired for another item")
+	}
+	table.Value(k + "_1")
+	table.Value(k + "_1")
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Error("Access callback not fired on every read", calls)
+	}
+
+	// reads that don't touch the item don't count as an access
+	table.Peek(k + "_1")
+	table.Lookup(k+"_1", NoTouch())
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Error("Access callback fired for a read without touch", calls)
+	}
+}
+
+func TestMaxAgeReschedulesPermanentItems(t *testing.T) {
+	table := Cache("testMaxAgeReschedulesPermanentItems")
+	table.SetMaxAge(200 * time.Millisecond)
+	table.Add(k+"_1", 0, v)
+	time.Sleep(100 * time.Millisecond)
+	table.Add(k+"_2", 0, v)
+
+	// with only permanent items, maxAge must keep the sweep scheduled
+	time.Sleep(150 * time.Millisecond)
+	if table.Exists(k+"_1") || !table.Exists(k+"_2") {
+		t.Error("Sweep didn't run for the first permanent item")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k + "_2") {
+		t.Error("Sweep wasn't rescheduled for the remaining permanent item")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	table := Cache("testRotate")
+	table.Add(k+"_0", 0, 0)
+	var deleted, added int32
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		atomic.AddInt32(&deleted, 1)
+	})
+	table.SetAddedItemCallback(func(item *CacheItem) {
+		atomic.AddInt32(&added, 1)
+	})
+
+	if _, err := table.Rotate(k+"_missing", k+"_x", v, 0); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound rotating a missing key", err)
+	}
+
+	const rotations = 200
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// a snapshot always holds exactly one generation, old or new
+				if keys := table.Keys(); len(keys) != 1 {
+					t.Error("Reader saw an inconsistent table", keys)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < rotations; i++ {
+		old, err := table.Rotate(k+"_"+strconv.Itoa(i), k+"_"+strconv.Itoa(i+1), i+1, 0)
+		if err != nil || old.Data().(int) != i {
+			t.Fatal("Error rotating item", i, err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if table.Count() != 1 || !table.Exists(k+"_"+strconv.Itoa(rotations)) {
+		t.Error("Rotation left the table inconsistent", table.Keys())
+	}
+	if atomic.LoadInt32(&deleted) != rotations || atomic.LoadInt32(&added) != rotations {
+		t.Error("Rotation didn't fire the callbacks", deleted, added)
+	}
+}
+
+func TestOnSlowLoad(t *testing.T) {
+	table := Cache("testOnSlowLoad")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		if key == k+"_slow" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		return NewCacheItem(key, 0, v)
+	})
+	type slowLoad struct {
+		key  interface{}
+		took time.Duration
+	}
+	slow := make(chan slowLoad, 2)
+	table.SetOnSlowLoad(20*time.Millisecond, func(key interface{}, took time.Duration) {
+		slow <- slowLoad{key, took}
+	})
+
+	table.Value(k + "_fast")
+	table.Value(k + "_slow")
+	select {
+	case s := <-slow:
+		if s.key != k+"_slow" || s.took < 30*time.Millisecond {
+			t.Error("Slow load hook got the wrong key or duration", s)
+		}
+	default:
+		t.Error("Slow load hook not fired")
+	}
+	if len(slow) != 0 {
+		t.Error("Slow load hook fired for a fast load")
+	}
+
+	s := table.Stats()
+	if s.Loads != 2 || s.MaxLoadTime < 30*time.Millisecond || s.LoadTime < s.MaxLoadTime {
+		t.Error("Error recording load stats", s)
+	}
+}
+
+func TestExportProto(t *testing.T) {
+	src := Cache("testExportProto")
+	src.Add(k+"_1", time.Hour, v)
+	src.AddWithTTLandTTI(k+"_2", 42, 2*time.Hour, time.Hour)
+	src.Value(k + "_1")
+
+	marshal := func(v interface{}) ([]byte, string) {
+		switch d := v.(type) {
+		case string:
+			return []byte(d), "string"
+		case int:
+			return []byte(strconv.Itoa(d)), "int"
+		}
+		return nil, ""
+	}
+	unmarshal := func(b []byte, typ string) (interface{}, error) {
+		switch typ {
+		case "string":
+			return string(b), nil
+		case "int":
+			return strconv.Atoi(string(b))
+		}
+		return nil, errors.New("unknown type " + typ)
+	}
+
+	protos := src.ExportProto(marshal)
+	if len(protos) != 2 || string(protos[0].Key) != k+"_1" || protos[0].AccessCount != 1 {
+		t.Fatal("Error exporting items", protos)
+	}
+
+	dst := Cache("testExportProtoImport")
+	if err := dst.ImportProto(protos, unmarshal); err != nil {
+		t.Fatal("Error importing items", err)
+	}
+	for _, key := range []string{k + "_1", k + "_2"} {
+		a, _ := src.Peek(key)
+		b, err := dst.Peek(key)
+		if err != nil || a.Data() != b.Data() || a.LifeSpan() != b.LifeSpan() ||
+			a.AbsoluteLifeSpan() != b.AbsoluteLifeSpan() || !a.CreatedOn().Equal(b.CreatedOn()) ||
+			a.AccessCount() != b.AccessCount() {
+			t.Error("Error round-tripping item", key)
+		}
+	}
+
+	// write errors are reported instead of silently dropping items
+	quiesced := NewNamespace().Cache("testExportProtoQuiesced")
+	quiesced.Quiesce()
+	if err := quiesced.ImportProto(protos, unmarshal); err != ErrTableQuiesced || quiesced.Count() != 0 {
+		t.Error("Expected ErrTableQuiesced importing into a quiesced table", err)
+	}
+	errRejected := errors.New("rejected")
+	rejecting := NewNamespace().Cache("testExportProtoRejected")
+	rejecting.SetOnWrite(func(key, data interface{}) (interface{}, error) {
+		if key == k+"_1" {
+			return nil, errRejected
+		}
+		return data, nil
+	})
+	if err := rejecting.ImportProto(protos, unmarshal); err != errRejected || rejecting.Count() != 1 {
+		t.Error("Expected the rejection to be reported and other items imported", err, rejecting.Count())
+	}
+
+	protos[0].DataType = "bogus"
+	if err := Cache("testExportProtoBad").ImportProto(protos, unmarshal); err == nil {
+		t.Error("Expected error importing undecodable data")
+	}
+}
+
+func TestMaxConcurrentLoads(t *testing.T) {
+	table := Cache("testMaxConcurrentLoads")
+	var running, peak int32
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return NewCacheItem(key, 0, v)
+	})
+	table.SetMaxConcurrentLoads(3, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := table.Value(k + strconv.Itoa(i)); err != nil {
+				t.Error("Blocking load failed", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if p := atomic.LoadInt32(&peak); p > 3 {
+		t.Error("More loaders ran concurrently than allowed", p)
+	}
+
+	table.SetMaxConcurrentLoads(1, true)
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := table.Value(k + "_failfast" + strconv.Itoa(i))
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	exceeded := 0
+	for err := range errs {
+		if err == ErrLoadConcurrencyExceeded {
+			exceeded++
+		}
+	}
+	if exceeded == 0 {
+		t.Error("Fail fast mode never rejected a load")
+	}
+}
+
+func TestScope(t *testing.T) {
+	table := Cache("testScope")
+	users := table.Scope("users")
+	orders := table.Scope("orders")
+	users.Add(k, 0, "user")
+	orders.Add(k, 0, "order")
+
+	if p, err := users.Value(k); err != nil || p.Data() != "user" {
+		t.Error("Error retrieving scoped value", err)
+	}
+	if p, err := orders.Value(k); err != nil || p.Data() != "order" {
+		t.Error("Scopes are not isolated", err)
+	}
+	if !table.Exists("users:"+k) || !table.Exists("orders:"+k) || table.Exists(k) {
+		t.Error("Underlying keys don't carry the prefix", table.Keys())
+	}
+	if keys := users.Keys(); len(keys) != 1 || keys[0] != k {
+		t.Error("Prefix not stripped on enumeration", keys)
+	}
+
+	orders.Delete(k)
+	if orders.Exists(k) || !users.Exists(k) {
+		t.Error("Delete crossed scopes")
+	}
+	users.Scope("admins").Add(k, 0, v)
+	if !table.Exists("users:admins:" + k) {
+		t.Error("Nested scope not prefixed", table.Keys())
+	}
+}
+
+func TestExtendIfExpiringSoon(t *testing.T) {
+	table := Cache("testExtendIfExpiringSoon")
+	table.Add(k, 100*time.Millisecond, v)
+
+	if ok, err := table.ExtendIfExpiringSoon(k, 20*time.Millisecond, 100*time.Millisecond); ok || err != nil {
+		t.Error("Extended an item that isn't expiring soon", err)
+	}
+	time.Sleep(90 * time.Millisecond)
+	if ok, err := table.ExtendIfExpiringSoon(k, 20*time.Millisecond, 100*time.Millisecond); !ok || err != nil {
+		t.Error("Didn't extend an item about to expire", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Extended item expired at its old deadline")
+	}
+	if _, err := table.ExtendIfExpiringSoon(k+"_missing", time.Second, time.Second); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound", err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	table := Cache("testBloomFilter")
+	if !table.MightContain(k) {
+		t.Error("MightContain must be conservative without a filter")
+	}
+	table.Add(k+"_0", 0, v)
+	table.EnableBloomFilter(1000, 0.01)
+	for i := 1; i < 1000; i++ {
+		table.Add(k+"_"+strconv.Itoa(i), 0, v)
+	}
+	for i := 0; i < 1000; i++ {
+		if !table.MightContain(k + "_" + strconv.Itoa(i)) {
+			t.Fatal("False negative for a present key", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if table.MightContain(k + "_absent_" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Error("Too many false positives", falsePositives)
+	}
+
+	var loads int32
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		atomic.AddInt32(&loads, 1)
+		return NewCacheItem(key, 0, v)
+	})
+	table.AddToBloomFilter(k + "_loadable")
+	if _, err := table.Value(k + "_loadable"); err != nil {
+		t.Error("Seeded key not loaded", err)
+	}
+	if _, err := table.Value(k + "_definitely_absent"); err != ErrKeyNotFoundOrLoadable || atomic.LoadInt32(&loads) != 1 {
+		t.Error("Bloom filter didn't short-circuit the loader", err, loads)
+	}
+
+	table.Delete(k + "_0")
+	table.RebuildBloomFilter()
+	if !table.MightContain(k + "_1") {
+		t.Error("Rebuild dropped a present key")
+	}
+}
+
+func TestMaxItems(t *testing.T) {
+	table := Cache("testMaxItems")
+	table.SetMaxItems(3)
+	base := table.Stats().Evictions
+	var evicted []interface{}
+	var mu sync.Mutex
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		mu.Lock()
+		evicted = append(evicted, item.Key())
+		mu.Unlock()
+	})
+	for i := 0; i < 3; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+		time.Sleep(time.Millisecond)
+	}
+	table.Value(k + "0")
+	table.Add(k+"3", 0, v)
+
+	if table.Count() != 3 || table.Exists(k+"1") || !table.Exists(k+"0") || !table.Exists(k+"3") {
+		t.Error("Least recently used item not evicted", table.Keys())
+	}
+	mu.Lock()
+	if len(evicted) != 1 || evicted[0] != k+"1" {
+		t.Error("Eviction didn't fire the delete callback", evicted)
+	}
+	mu.Unlock()
+
+	table.SetMaxItems(1)
+	if table.Count() != 1 {
+		t.Error("Lowering the cap didn't evict", table.Count())
+	}
+	if n := table.Stats().Evictions - base; n != 3 {
+		t.Error("Expected 3 evictions in the stats, got", n)
+	}
+}
+
+func TestHighWatermark(t *testing.T) {
+	table := Cache("testHighWatermark")
+	table.SetMaxItems(10)
+	var fired []int
+	table.SetOnHighWatermark(0.8, func(count, cap int) {
+		if cap != 10 {
+			t.Error("Wrong cap passed to the watermark callback", cap)
+		}
+		fired = append(fired, count)
+	})
+
+	for i := 0; i < 10; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+	}
+	if len(fired) != 1 || fired[0] != 8 {
+		t.Fatal("High watermark didn't fire exactly once", fired)
+	}
+
+	table.Delete(k + "9")
+	table.Delete(k + "8")
+	table.Delete(k + "7")
+	table.Add(k+"7", 0, v)
+	if len(fired) != 2 {
+		t.Error("High watermark didn't re-arm after dropping below it", fired)
+	}
+}
+
+func TestEvictionTieBreak(t *testing.T) {
+	table := Cache("testEvictionTieBreak")
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+	}
+	for _, i := range []int{3, 1, 4, 0, 2} {
+		table.SetAccessedOn(k+strconv.Itoa(i), now)
+	}
+
+	table.SetMaxItems(3)
+	if table.Exists(k+"0") || table.Exists(k+"1") || !table.Exists(k+"2") {
+		t.Error("Eviction didn't fall back to insertion order", table.Keys())
+	}
+}
+
+func TestSortedItems(t *testing.T) {
+	table := Cache("testSortedItems")
+	for _, i := range []int{2, 0, 1} {
+		table.Add(i, 0, v)
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		table.Value(1)
+	}
+	table.Value(2)
+	time.Sleep(time.Millisecond)
+	table.Value(0)
+
+	keys := func(items []*CacheItem) []interface{} {
+		var r []interface{}
+		for _, item := range items {
+			r = append(r, item.Key())
+		}
+		return r
+	}
+	for _, c := range []struct {
+		by   SortField
+		desc bool
+		want []interface{}
+	}{
+		{SortByCreatedOn, false, []interface{}{2, 0, 1}},
+		{SortByCreatedOn, true, []interface{}{1, 0, 2}},
+		{SortByAccessedOn, false, []interface{}{1, 2, 0}},
+		{SortByAccessedOn, true, []interface{}{0, 2, 1}},
+		{SortByAccessCount, false, []interface{}{0, 2, 1}},
+		{SortByAccessCount, true, []interface{}{1, 0, 2}},
+		{SortByKey, false, []interface{}{0, 1, 2}},
+		{SortByKey, true, []interface{}{2, 1, 0}},
+	} {
+		got := keys(table.SortedItems(c.by, c.desc))
+		for i := range c.want {
+			if got[i] != c.want[i] {
+				t.Error("Wrong order for field", c.by, "desc", c.desc, got)
+				break
+			}
+		}
+	}
+}
+
+func TestForeachSafe(t *testing.T) {
+	table := Cache("testForeachSafe")
+	for i := 0; i < 100; i++ {
+		table.Add(i, 0, v)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i += 2 {
+			table.Delete(i)
+		}
+	}()
+	visited := map[interface{}]bool{}
+	table.ForeachSafe(func(key interface{}, item *CacheItem) bool {
+		// mutating the table from the callback must not deadlock
+		table.Add(key.(int)+1000, 0, v)
+		visited[key] = true
+		return true
+	})
+	<-done
+
+	for i := 1; i < 100; i += 2 {
+		if !visited[i] {
+			t.Error("Surviving item not visited", i)
+		}
+	}
+
+	n := 0
+	table.ForeachSafe(func(key interface{}, item *CacheItem) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Error("ForeachSafe didn't stop early", n)
+	}
+}
+
+func TestContextValue(t *testing.T) {
+	table := Cache("testContextValue")
+	if _, ok := table.ContextValue("tenant"); ok {
+		t.Error("Unset context value found")
+	}
+	table.SetContextValue("tenant", "acme")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		tenant, _ := table.ContextValue("tenant")
+		return NewCacheItem(key, 0, tenant.(string)+"/"+key.(string))
+	})
+	// onWrite runs under the table lock and must still be able to read it
+	table.SetOnWrite(func(key, data interface{}) (interface{}, error) {
+		if _, ok := table.ContextValue("tenant"); !ok {
+			return nil, errors.New("missing tenant")
+		}
+		return data, nil
+	})
+
+	if p, err := table.Value(k); err != nil || p.Data().(string) != "acme/"+k {
+		t.Error("Loader couldn't read the context value", err)
+	}
+}
+
+func TestCaseInsensitiveTableNames(t *testing.T) {
+	ns := NewNamespace()
+	if ns.Cache("Users") == ns.Cache("users") {
+		t.Error("Table names matched case-insensitively by default")
+	}
+
+	ns = NewNamespace()
+	ns.SetCaseInsensitiveTableNames(true)
+	users := ns.Cache("Users")
+	if ns.Cache("users") != users || ns.Cache("USERS") != users {
+		t.Error("Table names not matched case-insensitively")
+	}
+	if tables := ns.Tables(); len(tables) != 1 || tables[0] != "Users" {
+		t.Error("Error listing case-insensitive tables", tables)
+	}
+	users.Add(k, 0, v)
+	if !ns.DeleteTable("uSeRs") || len(ns.Tables()) != 0 || users.Count() != 0 {
+		t.Error("Error deleting table case-insensitively")
+	}
+	if ns.DeleteTable("users") {
+		t.Error("Deleted a table that no longer exists")
+	}
+}
+
+func TestDeadlineFunc(t *testing.T) {
+	table := Cache("testDeadlineFunc")
+	table.Add(k, 0, v)
+	exp := time.Now().Add(100 * time.Millisecond)
+	if err := table.SetDeadlineFunc(k, func() time.Time { return exp }); err != nil {
+		t.Fatal("Error setting deadline func", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Item swept before its external deadline")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Item not swept at its external deadline")
+	}
+	if err := table.SetDeadlineFunc(k, nil); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound", err)
+	}
+}
+
+func TestMoveWhere(t *testing.T) {
+	hot := Cache("testMoveWhere")
+	archive := Cache("testMoveWhereArchive")
+	hot.Add(k+"_cold_1", 0, v)
+	hot.Add(k+"_cold_2", 0, v)
+	time.Sleep(50 * time.Millisecond)
+	hot.Add(k+"_hot", 0, v)
+	hot.Value(k + "_cold_1")
+
+	var deleted, added int32
+	hot.SetAboutToDeleteItemCallback(func(item *CacheItem) { atomic.AddInt32(&deleted, 1) })
+	archive.SetAddedItemCallback(func(item *CacheItem) { atomic.AddInt32(&added, 1) })
+
+	n := hot.MoveWhere(archive, func(item *CacheItem) bool {
+		return item.IdleTime() > 25*time.Millisecond
+	})
+	if n != 1 {
+		t.Error("Wrong number of items moved", n)
+	}
+	if hot.Count() != 2 || hot.Exists(k+"_cold_2") {
+		t.Error("Moved item still in the source table", hot.Keys())
+	}
+	p, err := archive.Peek(k + "_cold_2")
+	if err != nil || archive.Count() != 1 || p.Data() != v {
+		t.Error("Moved item missing from the destination table", archive.Keys())
+	}
+	if atomic.LoadInt32(&deleted) != 1 || atomic.LoadInt32(&added) != 1 {
+		t.Error("Move didn't fire the callbacks", deleted, added)
+	}
+}
+
+func TestStaleHits(t *testing.T) {
+	table := Cache("testStaleHits")
+	table.SetLazyExpiration(true)
+	table.Add(k+"_lazy", 10*time.Millisecond, v)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := table.Value(k + "_lazy"); err == nil {
+		t.Error("Lazily expired item returned")
+	}
+	if s := table.Stats(); s.StaleHits != 1 {
+		t.Error("Stale hit not counted in lazy mode", s.StaleHits)
+	}
+
+	// an item past its deadline that the sweep hasn't reached yet:
+	// setting the deadline on the item directly doesn't reschedule the sweep
+	table.SetLazyExpiration(false)
+	item := table.Add(k, 0, v)
+	item.SetDeadlineFunc(func() time.Time { return time.Now().Add(-time.Second) })
+	if _, err := table.Value(k); err != nil {
+		t.Error("Unswept item not returned", err)
+	}
+	if s := table.Stats(); s.StaleHits != 2 {
+		t.Error("Stale hit not counted for an unswept item", s.StaleHits)
+	}
+}
+
+func TestRankingRefreshInterval(t *testing.T) {
+	table := Cache("testRankingRefreshInterval")
+	for i := 0; i < 20; i++ {
+		table.Add(i, 0, v)
+	}
+	table.Value(3)
+	table.SetRankingRefreshInterval(time.Hour)
+
+	sorts := atomic.LoadInt64(&table.rankSorts)
+	first := table.MostAccessed(1)
+	table.Value(5)
+	table.Value(5)
+	second := table.MostAccessed(1)
+	if atomic.LoadInt64(&table.rankSorts) != sorts+1 {
+		t.Error("MostAccessed re-sorted within the refresh interval")
+	}
+	if first[0].Key() != 3 || second[0].Key() != 3 {
+		t.Error("Cached ranking not reused")
+	}
+
+	for i := 20; i < 25; i++ {
+		table.Add(i, 0, v)
+	}
+	if table.MostAccessed(1)[0].Key() != 5 || atomic.LoadInt64(&table.rankSorts) != sorts+2 {
+		t.Error("Ranking not invalidated after significant churn")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	table := NewNamespace().Cache("testAggregate")
+	extract := func(item *CacheItem) (float64, bool) {
+		x, ok := item.Data().(float64)
+		return x, ok
+	}
+	if r := table.Aggregate(extract); r != (AggResult{}) {
+		t.Error("Non-zero aggregate over an empty table", r)
+	}
+	for i, x := range []float64{4, -2, 10, 8} {
+		table.Add(i, 0, x)
+	}
+	table.Add("label", 0, v)
+
+	r := table.Aggregate(extract)
+	if r != (AggResult{Count: 4, Sum: 20, Min: -2, Max: 10, Avg: 5}) {
+		t.Error("Error aggregating numeric payloads", r)
+	}
+}
+
+func TestQuiesce(t *testing.T) {
+	table := Cache("testQuiesce")
+	table.Add(k, 0, v)
+	table.Quiesce()
+
+	if _, err := table.AddWithError(k+"_new", 0, v); err != ErrTableQuiesced {
+		t.Error("Add succeeded on a quiesced table", err)
+	}
+	if _, err := table.Delete(k); err != ErrTableQuiesced {
+		t.Error("Delete succeeded on a quiesced table", err)
+	}
+	if err := table.UpdateValue(k, v+"_new"); err != ErrTableQuiesced {
+		t.Error("UpdateValue succeeded on a quiesced table", err)
+	}
+	if p, err := table.Value(k); err != nil || p.Data() != v || table.Count() != 1 {
+		t.Error("Reads failed on a quiesced table", err)
+	}
+	if _, err := table.Peek(k); err != nil {
+		t.Error("Peek failed on a quiesced table", err)
+	}
+
+	table.Unquiesce()
+	if err := table.UpdateValue(k, v+"_new"); err != nil {
+		t.Error("UpdateValue failed after Unquiesce", err)
+	}
+	if table.Add(k+"_new", 0, v) == nil {
+		t.Error("Add failed after Unquiesce")
+	}
+	if _, err := table.Delete(k); err != nil {
+		t.Error("Delete failed after Unquiesce", err)
+	}
+}
+
+type testUser struct {
+	Name  string
+	Email string
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	table := Cache("testSecondaryIndex")
+	table.Add(1, 0, testUser{"alice", "alice@example.com"})
+	table.AddIndex("email", func(item *CacheItem) (interface{}, bool) {
+		u, ok := item.Data().(testUser)
+		return u.Email, ok
+	})
+	table.Add(2, 0, testUser{"bob", "bob@example.com"})
+	table.Add(3, 50*time.Millisecond, testUser{"bobby", "bob@example.com"})
+	table.Add(4, 0, v)
+
+	if r, err := table.ValueByIndex("email", "alice@example.com"); err != nil || len(r) != 1 || r[0].Key() != 1 {
+		t.Error("Existing item not indexed", r, err)
+	}
+	if r, err := table.ValueByIndex("email", "bob@example.com"); err != nil || len(r) != 2 || r[0].Key() != 2 {
+		t.Error("Error looking up items by index", r, err)
+	}
+	if _, err := table.ValueByIndex("name", "bob"); err != ErrIndexNotFound {
+		t.Error("Expected ErrIndexNotFound", err)
+	}
+
+	table.UpdateValue(1, testUser{"alice", "alice@example.org"})
+	if _, err := table.ValueByIndex("email", "alice@example.com"); err != ErrKeyNotFound {
+		t.Error("Index not updated with the data", err)
+	}
+	table.Delete(1)
+	if _, err := table.ValueByIndex("email", "alice@example.org"); err != ErrKeyNotFound {
+		t.Error("Deleted item still indexed", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if r, _ := table.ValueByIndex("email", "bob@example.com"); len(r) != 1 {
+		t.Error("Expired item still indexed", r)
+	}
+}
+
+func TestSecondaryIndexStaleAndClosed(t *testing.T) {
+	table := NewNamespace().Cache("testSecondaryIndexStaleAndClosed")
+	table.SetLazyExpiration(true)
+	table.AddIndex("email", func(item *CacheItem) (interface{}, bool) {
+		u, ok := item.Data().(testUser)
+		return u.Email, ok
+	})
+	table.Add(1, 0, testUser{"bob", "bob@example.com"})
+	table.Add(2, 20*time.Millisecond, testUser{"bobby", "bob@example.com"})
+
+	// expired items are misses even before a sweep removes them
+	time.Sleep(50 * time.Millisecond)
+	if r, err := table.ValueByIndex("email", "bob@example.com"); err != nil || len(r) != 1 || r[0].Key() != 1 {
+		t.Error("Stale item returned by index lookup", r, err)
+	}
+
+	table.Close()
+	if _, err := table.ValueByIndex("email", "bob@example.com"); err != ErrKeyNotFound {
+		t.Error("Expected a miss looking up a closed table", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	table := Cache("testClose")
+	table.Add(k, 100*time.Millisecond, v)
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+	table.Close()
+	table.Close()
+
+	if !table.IsClosed() {
+		t.Error("Table not marked closed")
+	}
+	if _, err := table.AddWithError(k, 0, v); err != ErrTableClosed {
+		t.Error("Expected ErrTableClosed adding to a closed table", err)
+	}
+	if _, err := table.Delete(k); err != ErrTableClosed {
+		t.Error("Expected ErrTableClosed deleting from a closed table", err)
+	}
+	if _, err := table.Value(k); err != ErrKeyNotFound || table.Count() != 0 {
+		t.Error("Reads on a closed table must miss", err)
+	}
+	for _, name := range Tables() {
+		if name == "testClose" {
+			t.Error("Closed table still registered")
+		}
+	}
+	if Cache("testClose") == table {
+		t.Error("Cache returned the closed table")
+	}
+}
+
+func TestExpiredChannel(t *testing.T) {
+	table := Cache("testExpiredChannel")
+	ch := table.ExpiredChannel(10)
+	full := table.ExpiredChannel(1)
+	table.Add(k+"_1", 20*time.Millisecond, v)
+	table.Add(k+"_2", 20*time.Millisecond, v)
+	table.Add(k+"_3", 0, v)
+
+	got := map[interface{}]bool{}
+	for len(got) < 2 {
+		select {
+		case item := <-ch:
+			got[item.Key()] = true
+		case <-time.After(time.Second):
+			t.Fatal("Expired items didn't arrive on the channel", got)
+		}
+	}
+	if !got[k+"_1"] || !got[k+"_2"] {
+		t.Error("Wrong items on the expired channel", got)
+	}
+	if len(full) != 1 {
+		t.Error("Full channel didn't drop items", len(full))
+	}
+
+	table.Close()
+	if _, ok := <-ch; ok {
+		t.Error("Channel not closed with the table")
+	}
+}
+
+func TestAddBatchRespectsMaxItems(t *testing.T) {
+	table := NewNamespace().Cache("testAddBatchRespectsMaxItems")
+	table.SetMaxItems(4)
+	table.Add(k+"_old_1", 0, v)
+	table.Add(k+"_old_2", 0, v)
+	table.Value(k + "_old_2")
+
+	var entries []BatchEntry
+	for i := 0; i < 3; i++ {
+		entries = append(entries, BatchEntry{Key: k + "_new_" + strconv.Itoa(i), Data: v})
+	}
+	table.AddBatch(entries)
+	if table.Count() != 4 || table.Exists(k+"_old_1") || !table.Exists(k+"_old_2") {
+		t.Error("Batch didn't evict the least recently used item", table.Keys())
+	}
+
+	// evictions happen under the batch's lock hold, so callbacks never see the table over capacity
+	var evicted int32
+	table.SetAboutToDeleteItemCallback(func(*CacheItem) {
+		atomic.AddInt32(&evicted, 1)
+		if n := table.Count(); n > 4 {
+			t.Error("Delete callback saw the table over capacity", n)
+		}
+	})
+	entries = entries[:0]
+	for i := 0; i < 6; i++ {
+		entries = append(entries, BatchEntry{Key: i, Data: v})
+	}
+	table.AddBatch(entries)
+	if table.Count() != 4 {
+		t.Error("Batch larger than the cap left the table over capacity", table.Count())
+	}
+	if n := atomic.LoadInt32(&evicted); n != 6 {
+		t.Error("Expected 6 delete callbacks for evicted items, got", n)
+	}
+	for i := 2; i < 6; i++ {
+		if !table.Exists(i) {
+			t.Error("Expected the last batch entries to survive", table.Keys())
+			break
+		}
+	}
+}
+
+func TestExpirationWheel(t *testing.T) {
+	table := Cache("testExpirationWheel")
+	table.Add(k+"_before", 30*time.Millisecond, v)
+	table.SetExpirationWheel(20*time.Millisecond, 10)
+	defer table.SetExpirationWheel(0, 0)
+	table.Add(k+"_short", 30*time.Millisecond, v)
+	table.Add(k+"_alive", 70*time.Millisecond, v)
+	table.Add(k+"_long", 300*time.Millisecond, v)
+	table.Add(k+"_permanent", 0, v)
+
+	time.Sleep(25 * time.Millisecond)
+	if !table.Exists(k+"_short") || !table.Exists(k+"_before") {
+		t.Error("Item expired before its deadline")
+	}
+	table.Value(k + "_alive")
+	// items expire at bucket granularity: within one resolution after the deadline
+	time.Sleep(55 * time.Millisecond)
+	if table.Exists(k+"_short") || table.Exists(k+"_before") {
+		t.Error("Item not expired within a bucket of its deadline")
+	}
+	if !table.Exists(k + "_alive") {
+		t.Error("Kept-alive item expired at its original deadline")
+	}
+	time.Sleep(170 * time.Millisecond)
+	if !table.Exists(k + "_long") {
+		t.Error("Item beyond the wheel span expired early")
+	}
+	time.Sleep(120 * time.Millisecond)
+	if table.Exists(k+"_long") || table.Exists(k+"_alive") || !table.Exists(k+"_permanent") {
+		t.Error("Wrong items left after a full rotation", table.Keys())
+	}
+}
+
+// cost of one expiration pass: the timer sweep scans every item, the wheel only visits one bucket
+func benchmarkExpirationPass(b *testing.B, wheel bool) {
+	table := NewNamespace().Cache("benchmarkExpirationPass")
+	table.DisableExpiration()
+	for i := 0; i < 200000; i++ {
+		table.items.Set(i, NewCacheItem(i, time.Hour+time.Duration(i)*time.Millisecond, v))
+	}
+	table.Lock()
+	table.expirationDisabled = false
+	table.Unlock()
+	w := newExpirationWheel(time.Second, 4096, time.Now())
+	if wheel {
+		table.Lock()
+		now := time.Now()
+		for _, item := range table.allItems() {
+			remaining, _ := item.remaining(now, 0)
+			w.schedule(item, remaining, now)
+		}
+		table.wheel = w
+		table.Unlock()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if wheel {
+			table.wheelTick(w)
+		} else {
+			table.expirationCheck()
+		}
+	}
+	b.StopTimer()
+	table.Close()
+}
+
+func BenchmarkExpirationScan(b *testing.B) {
+	benchmarkExpirationPass(b, false)
+}
+
+func BenchmarkExpirationWheel(b *testing.B) {
+	benchmarkExpirationPass(b, true)
+}
+
+func TestGetOrLoad(t *testing.T) {
+	table := Cache("testGetOrLoad")
+	var loads int32
+	load := func() (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(20 * time.Millisecond)
+		return v, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if p, err := table.GetOrLoad(k, time.Hour, load); err != nil || p.Data() != v {
+				t.Error("Error loading value", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Error("Load not coalesced", n)
+	}
+	if p, err := table.Peek(k); err != nil || p.LifeSpan() != time.Hour {
+		t.Error("Loaded value not stored with the supplied lifespan", err)
+	}
+
+	loadErr := errors.New("backend down")
+	if _, err := table.GetOrLoad(k+"_fail", 0, func() (interface{}, error) { return nil, loadErr }); err != loadErr || table.Exists(k+"_fail") {
+		t.Error("Load error not returned", err)
+	}
+}
+
+func TestCallbackCounts(t *testing.T) {
+	table := Cache("testCallbackCounts")
+	for i := 0; i < 3; i++ {
+		table.AddAddedItemCallback(func(item *CacheItem) {})
+	}
+	table.AddAboutToDeleteItemCallback(func(item *CacheItem) {})
+	if added, aboutToDelete := table.CallbackCounts(); added != 3 || aboutToDelete != 1 {
+		t.Error("Wrong callback counts", added, aboutToDelete)
+	}
+	table.RemoveAddedItemCallbacks()
+	if added, _ := table.CallbackCounts(); added != 0 {
+		t.Error("Callbacks not removed", added)
+	}
+
+	item := table.Add(k, 0, v)
+	item.AddAboutToExpireCallback(func(key interface{}) {})
+	item.AddAboutToExpireCallback(func(key interface{}) {})
+	if n := item.AboutToExpireCount(); n != 2 {
+		t.Error("Wrong about-to-expire callback count", n)
+	}
+}
+
+func TestUpdateBatchIf(t *testing.T) {
+	table := Cache("testUpdateBatchIf")
+	for i := 0; i < 4; i++ {
+		table.Add(i, 0, i)
+	}
+	var updated []interface{}
+	table.SetUpdatedItemCallback(func(item *CacheItem, oldData interface{}) {
+		if oldData != item.Key() {
+			t.Error("Wrong old data passed to the update callback", oldData)
+		}
+		updated = append(updated, item.Key())
+	})
+
+	r := table.UpdateBatchIf(map[interface{}]interface{}{0: 100, 1: 101, 2: 102, 9: 109},
+		func(key interface{}, item *CacheItem) bool {
+			return item.Data().(int)%2 == 0
+		})
+	want := map[interface{}]bool{0: true, 1: false, 2: true, 9: false}
+	for key, ok := range want {
+		if r[key] != ok {
+			t.Error("Wrong result for key", key, r[key])
+		}
+	}
+	for key, data := range map[int]int{0: 100, 1: 1, 2: 102, 3: 3} {
+		if p, _ := table.Peek(key); p.Data() != data {
+			t.Error("Wrong data after batch update", key, p.Data())
+		}
+	}
+	if len(updated) != 2 || updated[0] != 0 || updated[1] != 2 {
+		t.Error("Update callbacks not fired for applied entries", updated)
+	}
+}
+
+func TestAccessCountSaturates(t *testing.T) {
+	table := Cache("testAccessCountSaturates")
+	item := table.Add(k, 0, v)
+	item.Lock()
+	item.accessCount = math.MaxInt64 - 1
+	item.Unlock()
+
+	table.Value(k)
+	table.Value(k)
+	if n := item.AccessCount(); n != math.MaxInt64 {
+		t.Error("Access count didn't saturate", n)
+	}
+	table.BumpAccessCount(k, 10)
+	if n := item.AccessCount(); n != math.MaxInt64 {
+		t.Error("BumpAccessCount wrapped around", n)
+	}
+}
+
+func TestValueValidator(t *testing.T) {
+	table := Cache("testValueValidator")
+	table.Add(k+"_good", 0, v)
+	table.Add(k+"_bad", 0, "corrupt")
+	table.SetValueValidator(func(item *CacheItem) bool {
+		return item.Data() != "corrupt"
+	})
+
+	if _, err := table.Value(k + "_good"); err != nil {
+		t.Error("Valid item rejected", err)
+	}
+	if _, err := table.Value(k + "_bad"); err != ErrKeyNotFound {
+		t.Error("Invalid item served", err)
+	}
+	if table.Exists(k + "_bad") {
+		t.Error("Invalid item not removed")
+	}
+
+	table.Add(k+"_bad", 0, "corrupt")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+	if p, err := table.Value(k + "_bad"); err != nil || p.Data() != v {
+		t.Error("Invalid item not reloaded", err)
+	}
+}
+
+func TestDeferredDeletion(t *testing.T) {
+	table := Cache("testDeferredDeletion")
+	table.SetDeferredDeletion(50 * time.Millisecond)
+	item := table.Add(k, 0, v)
+	finalized := make(chan struct{})
+	table.SetFinalizer(k, func(data interface{}) { close(finalized) })
+
+	table.Delete(k)
+	if table.Exists(k) || table.Count() != 0 {
+		t.Error("Deleted item still visible")
+	}
+	if _, err := table.Value(k); err != ErrKeyNotFound {
+		t.Error("Deleted item still served", err)
+	}
+	if table.TombstoneCount() != 1 {
+		t.Error("Deleted item not tombstoned")
+	}
+	select {
+	case <-finalized:
+		t.Error("Item purged before the grace period")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// in-flight readers can still use the data
+	if item.Data() != v {
+		t.Error("Tombstoned item data not readable")
+	}
+
+	select {
+	case <-finalized:
+	case <-time.After(time.Second):
+		t.Error("Item not purged after the grace period")
+	}
+	if table.TombstoneCount() != 0 {
+		t.Error("Tombstone not cleared after the grace period")
+	}
+}
+
+func TestAddPermanent(t *testing.T) {
+	table := Cache("testAddPermanent")
+	p := table.AddPermanent(k+"permanent", v)
+	e := table.Add(k+"expiring", 50*time.Millisecond, v)
+	if !p.IsPermanent() {
+		t.Error("Permanent item not reported as permanent")
+	}
+	if e.IsPermanent() {
+		t.Error("Expiring item reported as permanent")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !table.Exists(k + "permanent") {
+		t.Error("Permanent item was swept")
+	}
+	if table.Exists(k + "expiring") {
+		t.Error("Expiring item was not swept")
+	}
+}
+
+func TestExpiringWithin(t *testing.T) {
+	table := Cache("testExpiringWithin")
+	table.Add(k+"1", 10*time.Second, v)
+	item := table.Add(k+"2", 200*time.Millisecond, v)
+	table.Add(k+"3", 0, v)
+	table.Add(k+"4", 100*time.Millisecond, v)
+	before := item.AccessedOn()
+
+	items := table.ExpiringWithin(time.Second)
+	if len(items) != 2 {
+		t.Fatal("Expected 2 items expiring within a second, got", len(items))
+	}
+	if items[0].Key() != k+"4" || items[1].Key() != k+"2" {
+		t.Error("Expiring items not ordered by remaining life", items[0].Key(), items[1].Key())
+	}
+	if !items[1].AccessedOn().Equal(before) || items[1].AccessCount() != 0 {
+		t.Error("ExpiringWithin changed access stats")
+	}
+}
+
+func TestHitCounter(t *testing.T) {
+	table := Cache("testHitCounter")
+	for i := int64(1); i <= 3; i++ {
+		if n, err := table.HitCounter(k, 100*time.Millisecond); n != i || err != nil {
+			t.Error("Expected count", i, "got", n)
+		}
+	}
+
+	// concurrent increments within the window must not be lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			table.HitCounter(k, 100*time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	if n, _ := table.HitCounter(k, 100*time.Millisecond); n != 14 {
+		t.Error("Expected count 14 after concurrent hits, got", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if n, _ := table.HitCounter(k, 100*time.Millisecond); n != 1 {
+		t.Error("Counter not reset after the window elapsed, got", n)
+	}
+
+	// a key holding other data is not clobbered by a counter
+	table.Add(k+"_data", 0, v)
+	if n, err := table.HitCounter(k+"_data", time.Second); n != 0 || err != ErrNotInt64Entry {
+		t.Error("Expected ErrNotInt64Entry counting a non-counter key, got", n, err)
+	}
+	if p, _ := table.Peek(k + "_data"); p.Data() != v {
+		t.Error("HitCounter replaced the stored data", p.Data())
+	}
+
+	// a quiesced table rejects increments like any other write
+	table.Quiesce()
+	defer table.Unquiesce()
+	if n, err := table.HitCounter(k, 100*time.Millisecond); n != 0 || err != ErrTableQuiesced {
+		t.Error("Expected ErrTableQuiesced incrementing a quiesced counter, got", n, err)
+	}
+	if p, _ := table.Peek(k); p.Data().(int64) != 1 {
+		t.Error("Quiesced counter was incremented", p.Data())
+	}
+}
+
+// manualScheduler records timers and only runs them when fired by the test.
+type manualScheduler struct {
+	mu     sync.Mutex
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	d       time.Duration
+	f       func()
+	stopped bool
+}
+
+func (s *manualScheduler) AfterFunc(d time.Duration, f func()) Timer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &manualTimer{d: d, f: f}
+	s.timers = append(s.timers, t)
+	return t
+}
+
+func (t *manualTimer) Stop() bool {
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+// fire runs every pending timer and reports how many ran.
+func (s *manualScheduler) fire() int {
+	s.mu.Lock()
+	timers := s.timers
+	s.timers = nil
+	s.mu.Unlock()
+	n := 0
+	for _, t := range timers {
+		if !t.stopped {
+			t.stopped = true
+			t.f()
+			n++
+		}
+	}
+	return n
+}
+
+func TestScheduler(t *testing.T) {
+	table := Cache("testScheduler")
+	sched := &manualScheduler{}
+	table.SetScheduler(sched)
+	expired := table.ExpiredChannel(1)
+	table.Add(k, 10*time.Millisecond, v)
+
+	sched.mu.Lock()
+	pending := len(sched.timers)
+	sched.mu.Unlock()
+	if pending != 1 {
+		t.Fatal("Expected one sweep scheduled on the manual scheduler, got", pending)
+	}
+
+	// the real clock passes the deadline, but nothing sweeps until the timer fires
+	time.Sleep(20 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Item swept without the scheduler firing")
+	}
+	if sched.fire() != 1 {
+		t.Error("Expected the sweep timer to fire")
+	}
+	select {
+	case item := <-expired:
+		if item.Key() != k {
+			t.Error("Unexpected item expired", item.Key())
+		}
+	case <-time.After(time.Second):
+		t.Error("Item not swept after the scheduler fired")
+	}
+}
+
+func TestCreationRank(t *testing.T) {
+	table := Cache("testCreationRank")
+	for i := 0; i < 3; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+		time.Sleep(time.Millisecond)
+	}
+	// touching an item must not change its creation rank
+	table.Value(k + "0")
+
+	for i := 0; i < 3; i++ {
+		rank, err := table.CreationRank(k + strconv.Itoa(i))
+		if err != nil || rank != i {
+			t.Error("Expected rank", i, "got", rank, err)
+		}
+	}
+	if _, err := table.CreationRank(k + "missing"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for a missing key, got", err)
+	}
+}
+
+// fifoPolicy evicts items strictly in insertion order, ignoring access.
+type fifoPolicy struct {
+	items []*CacheItem
+}
+
+func (p *fifoPolicy) Add(item *CacheItem) { p.items = append(p.items, item) }
+
+func (p *fifoPolicy) Touch(item *CacheItem) {}
+
+func (p *fifoPolicy) Remove(item *CacheItem) {
+	for i, it := range p.items {
+		if it == item {
+			p.items = append(p.items[:i], p.items[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *fifoPolicy) Evict() interface{} {
+	if len(p.items) == 0 {
+		return nil
+	}
+	item := p.items[0]
+	p.items = p.items[1:]
+	return item.Key()
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	table := Cache("testEvictionPolicy")
+	table.SetEvictionPolicy(&fifoPolicy{})
+	table.SetMaxItems(3)
+	for i := 0; i < 3; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+	}
+	// heavy access must not save the first-in item under FIFO
+	for i := 0; i < 10; i++ {
+		table.Value(k + "0")
+	}
+	table.Add(k+"3", 0, v)
+	table.Add(k+"4", 0, v)
+	if table.Exists(k+"0") || table.Exists(k+"1") {
+		t.Error("First-in items not evicted first")
+	}
+	if !table.Exists(k+"2") || !table.Exists(k+"3") || !table.Exists(k+"4") {
+		t.Error("Wrong items evicted")
+	}
+
+	// the built-in LFU policy keeps the frequently read item
+	lfu := Cache("testEvictionPolicyLFU")
+	lfu.SetEvictionPolicy(NewLFUPolicy())
+	lfu.SetMaxItems(2)
+	lfu.Add(k+"0", 0, v)
+	lfu.Add(k+"1", 0, v)
+	lfu.Value(k + "0")
+	lfu.Add(k+"2", 0, v)
+	if !lfu.Exists(k+"0") || lfu.Exists(k+"1") {
+		t.Error("LFU policy evicted the wrong item")
+	}
+
+	// the built-in LRU policy evicts the least recently read item
+	lru := Cache("testEvictionPolicyLRU")
+	lru.SetEvictionPolicy(NewLRUPolicy())
+	lru.SetMaxItems(2)
+	lru.Add(k+"0", 0, v)
+	lru.Add(k+"1", 0, v)
+	lru.Value(k + "0")
+	lru.Add(k+"2", 0, v)
+	if !lru.Exists(k+"0") || lru.Exists(k+"1") {
+		t.Error("LRU policy evicted the wrong item")
+	}
+}
+
+func TestAddChanged(t *testing.T) {
+	table := NewNamespace().Cache("testAddChanged")
+	var added int32
+	table.SetAddedItemCallback(func(item *CacheItem) {
+		atomic.AddInt32(&added, 1)
+	})
+
+	first, changed := table.AddChanged(k, 100*time.Millisecond, []string{"a", "b"})
+	if first == nil || !changed {
+		t.Error("First add not reported as a change")
+	}
+	time.Sleep(60 * time.Millisecond)
+	second, changed := table.AddChanged(k, 100*time.Millisecond, []string{"a", "b"})
+	if changed || second != first {
+		t.Error("Adding an equal value replaced the item")
+	}
+	if n := atomic.LoadInt32(&added); n != 1 {
+		t.Error("Expected one added callback, got", n)
+	}
+	// the unchanged add renewed the TTL
+	time.Sleep(60 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Unchanged add did not renew the item")
+	}
+
+	third, changed := table.AddChanged(k, 0, []string{"a", "c"})
+	if !changed || third == first {
+		t.Error("Different value not reported as a change")
+	}
+
+	// renewing with a shorter lifespan still reschedules the sweep
+	table.AddChanged(k+"_short", 10*time.Second, v)
+	table.AddChanged(k+"_short", 50*time.Millisecond, v)
+	time.Sleep(150 * time.Millisecond)
+	if table.Exists(k + "_short") {
+		t.Error("Renewed item with a shorter lifespan did not expire")
+	}
+
+	// a custom equality can ignore irrelevant differences
+	table.SetEqualFunc(func(a, b interface{}) bool {
+		return strings.EqualFold(a.(string), b.(string))
+	})
+	table.AddChanged(k+"s", 0, "Value")
+	if _, changed := table.AddChanged(k+"s", 0, "VALUE"); changed {
+		t.Error("Custom equality not used")
+	}
+}
+
+func TestAddChangedOnWrite(t *testing.T) {
+	table := NewNamespace().Cache("testAddChangedOnWrite")
+	table.SetOnWrite(func(key, data interface{}) (interface{}, error) {
+		return strings.ToUpper(data.(string)), nil
+	})
+	table.AddChanged(k, 0, "value")
+	// the stored data was transformed, an equal input still counts as unchanged
+	if _, changed := table.AddChanged(k, 0, "value"); changed {
+		t.Error("Unchanged data reported as a change with a transforming onWrite")
+	}
+
+	// a renewal counts as a use for the eviction policy
+	table.SetMaxItems(2)
+	table.AddChanged(k+"_2", 0, "value")
+	table.AddChanged(k, 0, "value")
+	table.AddChanged(k+"_3", 0, "value")
+	if !table.Exists(k) || table.Exists(k+"_2") {
+		t.Error("Renewed item was evicted instead of the least recently used one", table.Keys())
+	}
+}
+
+func TestClockJumpBackwards(t *testing.T) {
+	table := Cache("testClockJumpBackwards")
+	item := table.Add(k, 50*time.Millisecond, v)
+
+	// a wall-clock timestamp taken before the clock was stepped back by an hour
+	// now lies in the future; it must not keep the item alive for that hour
+	table.SetAccessedOn(k, time.Now().Add(time.Hour).Round(0))
+	if idle := item.IdleTime(); idle < 0 {
+		t.Error("Negative idle time after clock jump", idle)
+	}
+	if remaining, ok := item.remaining(time.Now(), 0); !ok || remaining > 50*time.Millisecond {
+		t.Error("Remaining life not bounded by the lifespan after clock jump", remaining)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Item did not expire after clock jump")
+	}
+}
+
+func TestModify(t *testing.T) {
+	table := Cache("testModify")
+	if _, err := table.Modify(k, func(data interface{}) interface{} { return data }); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound modifying a missing key, got", err)
+	}
+
+	table.Add(k, 0, []int{})
+	var updates int32
+	table.SetUpdatedItemCallback(func(item *CacheItem, oldData interface{}) {
+		atomic.AddInt32(&updates, 1)
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			table.Modify(k, func(data interface{}) interface{} {
+				return append(data.([]int), i)
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	item, _ := table.Value(k)
+	if n := len(item.Data().([]int)); n != 100 {
+		t.Error("Lost updates, expected 100 elements, got", n)
+	}
+	if n := atomic.LoadInt32(&updates); n != 100 {
+		t.Error("Expected 100 update callbacks, got", n)
+	}
+}
+
+func TestCallbackBudget(t *testing.T) {
+	table := Cache("testCallbackBudget")
+	table.SetCallbackBudget(20 * time.Millisecond)
+	var called int32
+	done := make(chan struct{})
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		time.Sleep(30 * time.Millisecond)
+		if atomic.AddInt32(&called, 1) == 5 {
+			close(done)
+		}
+	})
+	for i := 0; i < 5; i++ {
+		table.Add(k+strconv.Itoa(i), 10*time.Millisecond, v)
+	}
+	table.Add(k+"later", 300*time.Millisecond, v)
+
+	time.Sleep(100 * time.Millisecond)
+	// without a budget the sweep would take 5 * 30ms; with it only the first callback runs inline
+	if took := table.Stats().MaxCleanupDuration; took > 100*time.Millisecond {
+		t.Error("Sweep blocked on slow callbacks for", took)
+	}
+	if table.Count() != 1 {
+		t.Error("Expired items not removed promptly, count", table.Count())
+	}
+	table.RLock()
+	interval := table.cleanupInterval
+	table.RUnlock()
+	if interval <= 0 || interval > 300*time.Millisecond {
+		t.Error("Sweep not rescheduled for the remaining item, interval", interval)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Deferred callbacks did not all run, got", atomic.LoadInt32(&called))
+	}
+}
+
+func TestTopKTracker(t *testing.T) {
+	table := Cache("testTopKTracker")
+	tracker := table.TopKTracker(5)
+	var stream []string
+	for i := 0; i < 30; i++ {
+		key := k + strconv.Itoa(i)
+		table.Add(key, 0, v)
+		// skewed distribution: key i is read 600/(i+1) times
+		for j := 0; j < 600/(i+1); j++ {
+			stream = append(stream, key)
+		}
+	}
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Shuffle(len(stream), func(i, j int) { stream[i], stream[j] = stream[j], stream[i] })
+	for _, key := range stream {
+		table.Value(key)
+	}
+
+	exact := make(map[interface{}]bool)
+	for _, item := range table.MostAccessed(5) {
+		exact[item.Key()] = true
+	}
+	top := tracker.TopK()
+	if len(top) != 5 {
+		t.Fatal("Expected 5 tracked keys, got", len(top))
+	}
+	if top[0].Key != k+"0" {
+		t.Error("Most accessed key not ranked first", top[0].Key)
+	}
+	matched := 0
+	for _, p := range top {
+		if exact[p.Key] {
+			matched++
+		}
+	}
+	if matched < 4 {
+		t.Error("Tracked top-k too far from the exact top-k, matched", matched)
+	}
+
+	tracker.Stop()
+	table.Value(k + "0")
+	if tracker.TopK()[0].AccessCount != top[0].AccessCount {
+		t.Error("Stopped tracker still counting")
+	}
+}
+
+type codecPoint struct {
+	X, Y int
+}
+
+func TestRegisterCodec(t *testing.T) {
+	src := Cache("testRegisterCodec")
+	src.Add(k+"_point", 0, &codecPoint{X: 1, Y: 2})
+	src.Add(k+"_list", time.Minute, []int{3, 4, 5})
+
+	if _, err := src.ExportProtoCodecs(); !errors.Is(err, ErrNoCodec) {
+		t.Error("Expected ErrNoCodec without registered codecs, got", err)
+	}
+
+	register := func(table *CacheTable) {
+		// JSON for points, a hand-rolled comma separated format for int slices
+		table.RegisterCodec("*cache2go.codecPoint", func(v interface{}) ([]byte, error) {
+			return json.Marshal(v)
+		}, func(b []byte) (interface{}, error) {
+			p := &codecPoint{}
+			return p, json.Unmarshal(b, p)
+		})
+		table.RegisterCodec("[]int", func(v interface{}) ([]byte, error) {
+			var parts []string
+			for _, n := range v.([]int) {
+				parts = append(parts, strconv.Itoa(n))
+			}
+			return []byte(strings.Join(parts, ",")), nil
+		}, func(b []byte) (interface{}, error) {
+			var r []int
+			for _, s := range strings.Split(string(b), ",") {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					return nil, err
+				}
+				r = append(r, n)
+			}
+			return r, nil
+		})
+	}
+	register(src)
+	protos, err := src.ExportProtoCodecs()
+	if err != nil {
+		t.Fatal("Error exporting with codecs", err)
+	}
+	if protos[0].DataType != "[]int" || string(protos[0].Data) != "3,4,5" {
+		t.Error("Slice not encoded with its codec", protos[0].DataType, string(protos[0].Data))
+	}
+
+	dst := Cache("testRegisterCodecImport")
+	if err := dst.ImportProtoCodecs(protos); !errors.Is(err, ErrNoCodec) {
+		t.Error("Expected ErrNoCodec importing without codecs, got", err)
+	}
+	register(dst)
+	if err := dst.ImportProtoCodecs(protos); err != nil {
+		t.Fatal("Error importing with codecs", err)
+	}
+	p, err := dst.Value(k + "_point")
+	if err != nil || *p.Data().(*codecPoint) != (codecPoint{X: 1, Y: 2}) {
+		t.Error("Point not round-tripped", err)
+	}
+	l, err := dst.Value(k + "_list")
+	if err != nil || !reflect.DeepEqual(l.Data(), []int{3, 4, 5}) || l.LifeSpan() != time.Minute {
+		t.Error("Slice not round-tripped", err)
+	}
+}
+
+func TestDecrementAndMaybeDelete(t *testing.T) {
+	table := Cache("testDecrementAndMaybeDelete")
+	table.Add(k+"_str", 0, v)
+	if _, _, err := table.DecrementAndMaybeDelete(k+"_str", 1); err != ErrNotInt64Entry {
+		t.Error("Expected ErrNotInt64Entry, got", err)
+	}
+
+	table.Add(k, 0, int64(50))
+	var callbacks, deletions int32
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		atomic.AddInt32(&callbacks, 1)
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, deleted, err := table.DecrementAndMaybeDelete(k, 1); err == nil && deleted {
+				atomic.AddInt32(&deletions, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if deletions != 1 || callbacks != 1 {
+		t.Error("Expected exactly one deletion, got", deletions, "with", callbacks, "callbacks")
+	}
+	if table.Exists(k) {
+		t.Error("Item not deleted when the count reached zero")
+	}
+}
+
+func TestLoaderSkipCache(t *testing.T) {
+	table := Cache("testLoaderSkipCache")
+	var loads int32
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		atomic.AddInt32(&loads, 1)
+		// a degraded fallback that must not be cached
+		return NewCacheItem(key, 0, "fallback").SkipCache()
+	})
+
+	for i := 0; i < 2; i++ {
+		item, err := table.Value(k)
+		if err != nil || item.Data() != "fallback" {
+			t.Error("Loader result not returned", err)
+		}
+		if table.Exists(k) {
+			t.Error("Skip-cache loader result was stored")
+		}
+	}
+	if n := atomic.LoadInt32(&loads); n != 2 {
+		t.Error("Expected the loader to run on every miss, got", n)
+	}
+	if _, err := table.Value(k, "arg"); err != nil || table.Exists(k) {
+		t.Error("Skip-cache loader result with args was stored", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	table := Cache("testConfig")
+	c := table.Config()
+	if c.Name != "testConfig" || c.MaxItems != 0 || c.MaxCost != 0 || c.HasLoader || c.Indexes != nil {
+		t.Error("Unexpected default config", c)
+	}
+
+	table.SetMaxItems(100)
+	table.SetMaxCost(1000)
+	table.SetOnHighWatermark(0.9, func(count, cap int) {})
+	table.SetLowWatermark(0.5)
+	table.SetMaxAge(time.Hour)
+	table.SetKeepAliveThrottle(time.Second)
+	table.SetCallbackBudget(10 * time.Millisecond)
+	table.SetMaxConcurrentLoads(4, true)
+	table.SetLazyExpiration(true)
+	table.SetLogLevel(LogInfo)
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem { return nil })
+	table.AddIndex("b", func(*CacheItem) (interface{}, bool) { return nil, false })
+	table.AddIndex("a", func(*CacheItem) (interface{}, bool) { return nil, false })
+	table.Quiesce()
+
+	c = table.Config()
+	if c.MaxItems != 100 || c.MaxCost != 1000 || c.HighWatermark != 0.9 || c.LowWatermark != 0.5 {
+		t.Error("Capacity settings not reflected", c)
+	}
+	if c.MaxAge != time.Hour || c.KeepAliveThrottle != time.Second || c.CallbackBudget != 10*time.Millisecond || !c.LazyExpiration {
+		t.Error("Expiration settings not reflected", c)
+	}
+	if !c.HasLoader || c.MaxConcurrentLoads != 4 || !c.LoadFailFast {
+		t.Error("Loader settings not reflected", c)
+	}
+	if c.LogLevel != LogInfo || !c.Quiesced || !reflect.DeepEqual(c.Indexes, []string{"a", "b"}) {
+		t.Error("Other settings not reflected", c)
+	}
+}
+
+func TestDeleteByValue(t *testing.T) {
+	table := Cache("testDeleteByValue")
+	for i := 0; i < 3; i++ {
+		table.Add(k+strconv.Itoa(i), 0, "backend-a")
+	}
+	table.Add(k+"other", 0, "backend-b")
+	var deleted int32
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		atomic.AddInt32(&deleted, 1)
+	})
+
+	if n := table.DeleteByValue("backend-a"); n != 3 {
+		t.Error("Expected 3 items deleted, got", n)
+	}
+	if table.Count() != 1 || !table.Exists(k+"other") {
+		t.Error("Wrong items deleted")
+	}
+	if n := atomic.LoadInt32(&deleted); n != 3 {
+		t.Error("Expected 3 delete callbacks, got", n)
+	}
+}
+
+func TestMaxTables(t *testing.T) {
+	ns := NewNamespace()
+	ns.SetMaxTables(2)
+	var refused []string
+	ns.SetOnMaxTables(func(table string) {
+		refused = append(refused, table)
+	})
+	a := ns.Cache("a")
+	ns.Cache("b")
+	if ns.Cache("a") != a {
+		t.Error("Existing table not returned at the limit")
+	}
+
+	if _, err := ns.CacheWithError("c"); err != ErrTooManyTables {
+		t.Error("Expected ErrTooManyTables, got", err)
+	}
+	overflow := ns.Cache("d")
+	if !overflow.IsClosed() || overflow.Add(k, 0, v) != nil {
+		t.Error("Overflow table accepts writes")
+	}
+	if ns.Cache("e") != overflow {
+		t.Error("Overflow table not shared")
+	}
+	if len(ns.Tables()) != 2 {
+		t.Error("Tables created past the limit", ns.Tables())
+	}
+	if !reflect.DeepEqual(refused, []string{"c", "d", "e"}) {
+		t.Error("Limit hook not called for every refused table", refused)
+	}
+
+	// freeing a slot allows creating tables again
+	ns.DeleteTable("b")
+	if _, err := ns.CacheWithError("c"); err != nil {
+		t.Error("Table not created after freeing a slot", err)
+	}
+}
+
+func TestMaxCost(t *testing.T) {
+	table := Cache("testMaxCost")
+	table.SetMaxCost(100)
+	table.AddWithCost(k+"small1", 0, v, 10)
+	table.AddWithCost(k+"big", 0, v, 60)
+	table.AddWithCost(k+"small2", 0, v, 10)
+	if table.TotalCost() != 80 {
+		t.Error("Expected total cost 80, got", table.TotalCost())
+	}
+
+	// only 3 items, but the new item pushes the cost over budget:
+	// the least recently used items go until the total fits
+	table.Value(k + "big")
+	table.AddWithCost(k+"medium", 0, v, 30)
+	if table.Exists(k+"small1") || !table.Exists(k+"big") {
+		t.Error("Eviction did not follow LRU order")
+	}
+	if table.TotalCost() > 100 {
+		t.Error("Total cost over budget", table.TotalCost())
+	}
+
+	// a single expensive item evicts as many cheap ones as needed
+	table.AddWithCost(k+"huge", 0, v, 90)
+	if table.Count() != 1 || table.TotalCost() != 90 {
+		t.Error("Expected only the expensive item left, count", table.Count(), "cost", table.TotalCost())
+	}
+
+	// overwriting and deleting keep the total in sync
+	table.AddWithCost(k+"huge", 0, v, 40)
+	table.AddWithCost(k+"other", 0, v, 5)
+	table.Delete(k + "other")
+	if table.TotalCost() != 40 {
+		t.Error("Total cost out of sync, got", table.TotalCost())
+	}
+}
+
+func TestNextExpiry(t *testing.T) {
+	table := Cache("testNextExpiry")
+	table.SetMaxAge(time.Hour)
+	table.Add(k+"sliding", time.Minute, v)
+	table.Add(k+"permanent", 0, v)
+
+	// the sliding TTL comes first
+	at, ok, err := table.NextExpiry(k + "sliding")
+	if err != nil || !ok || time.Until(at) > time.Minute || time.Until(at) < 59*time.Second {
+		t.Error("Expected expiry in about a minute, got", time.Until(at), ok, err)
+	}
+	// without a sliding TTL the max age applies
+	at, ok, err = table.NextExpiry(k + "permanent")
+	if err != nil || !ok || time.Until(at) > time.Hour || time.Until(at) < 59*time.Minute {
+		t.Error("Expected expiry in about an hour, got", time.Until(at), ok, err)
+	}
+
+	// a max age shorter than the sliding TTL wins
+	table.SetMaxAge(time.Second)
+	at, ok, _ = table.NextExpiry(k + "sliding")
+	if !ok || time.Until(at) > time.Second {
+		t.Error("Expected the max age to win, got", time.Until(at))
+	}
+
+	table.SetMaxAge(0)
+	if _, ok, err := table.NextExpiry(k + "permanent"); ok || err != nil {
+		t.Error("Permanent item reported as expiring", err)
+	}
+	if _, _, err := table.NextExpiry(k + "missing"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+}
+
+func TestWithTables(t *testing.T) {
+	ns := NewNamespace()
+	a, b := ns.Cache("tenantA"), ns.Cache("tenantB")
+	for i := 0; i < 50; i++ {
+		a.Add(k+strconv.Itoa(i), 0, v)
+	}
+	var added int32
+	b.SetAddedItemCallback(func(*CacheItem) {
+		atomic.AddInt32(&added, 1)
+	})
+	// move moves key from src to dst through the transaction handle
+	move := func(src, dst *CacheTable, key string) {
+		WithTables([]*CacheTable{src, dst}, func(tx *Tx) {
+			item, err := tx.Delete(src, key)
+			if err != nil {
+				return
+			}
+			if err := tx.Set(dst, item); err != nil {
+				t.Error("Error moving item", err)
+			}
+		})
+	}
+
+	var wg sync.WaitGroup
+	var inconsistent int32
+	for i := 0; i < 50; i++ {
+		key := k + strconv.Itoa(i)
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			move(a, b, key)
+		}()
+		go func() {
+			defer wg.Done()
+			move(b, a, key)
+		}()
+		go func() {
+			defer wg.Done()
+			// passing the tables in the other order, and a duplicate, must not deadlock
+			WithTables([]*CacheTable{b, a, b}, func(tx *Tx) {
+				na, _ := tx.Count(a)
+				nb, _ := tx.Count(b)
+				if na+nb != 50 {
+					atomic.AddInt32(&inconsistent, 1)
+				}
+			})
+		}()
+	}
+	// MoveWhere uses the same lock order
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.MoveWhere(a, func(*CacheItem) bool { return true })
+	}()
+	wg.Wait()
+
+	if inconsistent != 0 {
+		t.Error("Observed an inconsistent total", inconsistent, "times")
+	}
+	if a.Count()+b.Count() != 50 {
+		t.Error("Items lost or duplicated, total", a.Count()+b.Count())
+	}
+	if atomic.LoadInt32(&added) == 0 {
+		t.Error("Moving into a table didn't fire its added callback")
+	}
+
+	// tables outside the transaction are rejected, deletes are applied on return
+	other := ns.Cache("other")
+	WithTables([]*CacheTable{a, b}, func(tx *Tx) {
+		if _, err := tx.Get(other, k); err != ErrTableNotInTx {
+			t.Error("Expected error accessing a table outside the transaction", err)
+		}
+		for i := 0; i < 50; i++ {
+			tx.Delete(a, k+strconv.Itoa(i))
+			tx.Delete(b, k+strconv.Itoa(i))
+		}
+		if _, err := tx.Get(a, k+"0"); err != ErrKeyNotFound {
+			t.Error("Deleted item still visible in the transaction", err)
+		}
+	})
+	if a.Count()+b.Count() != 0 {
+		t.Error("Deletes weren't applied", a.Count()+b.Count())
+	}
+}
+
+func TestEvictSkipsReaddedKey(t *testing.T) {
+	table := NewNamespace().Cache("testEvictSkipsReaddedKey")
+	table.Add(k+"_1", 0, v)
+	table.Add(k+"_2", 0, v)
+
+	table.Lock()
+	table.maxItems = 1
+	victims := table.evictionCandidates(nil)
+	table.Unlock()
+	if len(victims) != 1 || victims[0].Key() != k+"_1" {
+		t.Fatal("Unexpected eviction victims", victims)
+	}
+
+	// the victim's key is re-added after it was picked but before it is removed
+	fresh := table.Add(k+"_1", 0, "fresh")
+	table.evict(victims)
+	if item, err := table.Value(k + "_1"); err != nil || item != fresh {
+		t.Error("Re-added item was evicted in place of the stale one", err)
+	}
+}
+
+func TestKeepAliveThrottleClockStepBack(t *testing.T) {
+	table := NewNamespace().Cache("testKeepAliveThrottleClockStepBack")
+	table.SetKeepAliveThrottle(50 * time.Millisecond)
+	item := table.Add(k, 0, v)
+	item.KeepAlive()
+	if item.AccessCount() != 1 {
+		t.Fatal("First KeepAlive not applied")
+	}
+
+	// step the clock back by an hour; the reading carries no monotonic component
+	defer func() { clockNow = time.Now }()
+	clockNow = func() time.Time { return time.Now().Add(-time.Hour).Round(0) }
+	item.KeepAlive()
+	if item.AccessCount() != 2 {
+		t.Error("KeepAlive suppressed after the clock stepped back")
+	}
+	// the throttle keeps working on the stepped clock
+	item.KeepAlive()
+	if item.AccessCount() != 2 {
+		t.Error("KeepAlive not throttled after the clock stepped back")
+	}
+	time.Sleep(60 * time.Millisecond)
+	item.KeepAlive()
+	if item.AccessCount() != 3 {
+		t.Error("KeepAlive not renewed once the throttle interval passed")
+	}
+}
@@ -1,26 +1,54 @@
 package cache2go
 
 import (
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type CacheItem struct {
-	key  interface{}
-	data interface{}
+	// KeepAlive节流用的原子字段,放在结构体开头保证64位原子操作在32位平台上对齐
+	keepAliveThrottle int64 // 两次KeepAlive生效的最小间隔(纳秒),0表示不节流
+	lastKeepAlive     int64 // 上次KeepAlive生效的时间(相对monoBase的单调时钟纳秒数),0表示还没有生效过
+
+	// 构造时确定、之后不再修改的字段,读取时不需要加锁
+	key       interface{}
+	createdOn time.Time
+	// item的成本(比如占用的字节数),用于SetMaxCost的淘汰
+	cost int64
+	// 加入table时分配的递增序号,淘汰时作为访问时间相同的item的排序依据,由table的写锁保护
+	seq uint64
 
-	lifeSpan    time.Duration
-	createdOn   time.Time
-	accessedOn  time.Time
-	accessCount int64
+	// 以下字段可能被并发修改,读写都需要持有item的锁
+	data interface{}
+	// 空闲时间上限(time-to-idle),以accessedOn为起点,访问时会续期
+	lifeSpan time.Duration
+	// 绝对存活时间上限(time-to-live),以createdOn为起点,访问不会续期,0表示不限制
+	absoluteLifeSpan time.Duration
+	accessedOn       time.Time
+	accessCount      int64
 
 	// item被删除时触发的回调函数
 	aboutToExpire []func(key interface{})
+	// item从table中移除时(删除/到期/清空/覆盖)调用的清理函数,只会执行一次
+	finalizer    func(data interface{})
+	finalizeOnce sync.Once
+	// 每次通过Value读到这个item时调用的回调
+	onAccess func(item *CacheItem)
+	// 外部提供的到期时间,设置后代替lifeSpan作为空闲上限
+	deadlineFunc func() time.Time
+	// loadData返回的item不写入table,见SkipCache
+	skipCache bool
 	sync.RWMutex
 }
 
 func NewCacheItem(key interface{}, lifeSpan time.Duration, data interface{}) *CacheItem {
-	t := time.Now()
+	return newCacheItemAt(key, lifeSpan, data, time.Now())
+}
+
+// 以t作为创建时间构造item
+func newCacheItemAt(key interface{}, lifeSpan time.Duration, data interface{}, t time.Time) *CacheItem {
 	return &CacheItem{
 		key:         key,
 		lifeSpan:    lifeSpan,
@@ -31,19 +59,123 @@ func NewCacheItem(key interface{}, lifeSpan time.Duration, data interface{}) *Ca
 	}
 }
 
+// 外部传入的时间(比如从持久化数据中恢复的时间)没有单调时钟读数,系统时间回拨后可能晚于当前时间
+// 晚于now的按now处理,避免item因为经过的时间是负数而长期不过期
+func notAfter(t, now time.Time) time.Time {
+	if t.After(now) {
+		return now
+	}
+	return t
+}
+
+// 计算从t到now经过的时间,不会是负数
+func elapsed(now, t time.Time) time.Duration {
+	if d := now.Sub(t); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// 复制一个key不同、其它字段都相同的item,key是不可变的,改key只能复制
+func (item *CacheItem) withKey(key interface{}) *CacheItem {
+	item.RWMutex.RLock()
+	defer item.RWMutex.RUnlock()
+	return &CacheItem{
+		key:              key,
+		createdOn:        item.createdOn,
+		cost:             item.cost,
+		data:             item.data,
+		lifeSpan:         item.lifeSpan,
+		absoluteLifeSpan: item.absoluteLifeSpan,
+		accessedOn:       item.accessedOn,
+		accessCount:      item.accessCount,
+		aboutToExpire:    item.aboutToExpire,
+		finalizer:        item.finalizer,
+		onAccess:         item.onAccess,
+		deadlineFunc:     item.deadlineFunc,
+	}
+}
+
+// 标记loadData返回的item只返回给调用方、不写入table,适用于降级数据之类不应该缓存的结果
+// 返回item本身,方便在loadData中写成return NewCacheItem(key, 0, data).SkipCache()
+func (item *CacheItem) SkipCache() *CacheItem {
+	item.RWMutex.Lock()
+	defer item.RWMutex.Unlock()
+	item.skipCache = true
+	return item
+}
+
+// 是否被SkipCache标记为不写入table
+func (item *CacheItem) skipsCache() bool {
+	item.RWMutex.RLock()
+	defer item.RWMutex.RUnlock()
+	return item.skipCache
+}
+
+// item是否永不过期:没有空闲上限、绝对上限和deadlineFunc,不考虑table的maxAge
+func (item *CacheItem) IsPermanent() bool {
+	_, expires := item.remaining(time.Now(), 0)
+	return !expires
+}
+
 // 更新accessedOn,达到延长到期时间的目的
+// 设置了节流时,距离上次生效不足节流间隔的调用会被直接忽略,不加锁
 func (item *CacheItem) KeepAlive() {
+	now := clockNow()
+	if throttle := atomic.LoadInt64(&item.keepAliveThrottle); throttle > 0 {
+		// 用单调时钟计算间隔;时间没有单调时钟读数且发生了回拨时间隔是负数,这时不节流,
+		// 否则在时钟追上之前所有KeepAlive都会被忽略
+		mono := int64(now.Sub(monoBase))
+		last := atomic.LoadInt64(&item.lastKeepAlive)
+		if since := mono - last; last != 0 && since >= 0 && since < throttle ||
+			!atomic.CompareAndSwapInt64(&item.lastKeepAlive, last, mono) {
+			return
+		}
+	}
 	item.Lock()
 	defer item.Unlock()
-	item.accessedOn = time.Now()
-	item.accessCount++
+	item.accessedOn = now
+	item.accessCount = saturatingAdd(item.accessCount, 1)
+}
+
+// 饱和加法,溢出时停在MaxInt64/MinInt64而不是回绕,避免超热的key访问次数变成负数
+func saturatingAdd(a, b int64) int64 {
+	if b > 0 && a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	if b < 0 && a < math.MinInt64-b {
+		return math.MinInt64
+	}
+	return a + b
 }
 
 // 获取item的生命周期
 func (item *CacheItem) LifeSpan() time.Duration {
+	item.RWMutex.RLock()
+	defer item.RWMutex.RUnlock()
 	return item.lifeSpan
 }
 
+// 获取item的成本,见CacheTable.AddWithCost
+func (item *CacheItem) Cost() int64 {
+	return item.cost
+}
+
+// 获取item的绝对存活时间上限
+func (item *CacheItem) AbsoluteLifeSpan() time.Duration {
+	item.RWMutex.RLock()
+	defer item.RWMutex.RUnlock()
+	return item.absoluteLifeSpan
+}
+
+// 设置item的访问时间,用于从持久化数据中恢复时保留原来的到期进度
+// 直接修改item不会重新安排table的到期检查,item在table中时请用CacheTable.SetAccessedOn
+func (item *CacheItem) SetAccessedOn(t time.Time) {
+	item.RWMutex.Lock()
+	defer item.RWMutex.Unlock()
+	item.accessedOn = notAfter(t, time.Now())
+}
+
 // 获取item的访问时间
 func (item *CacheItem) AccessedOn() time.Time {
 	item.RWMutex.RLock()
@@ -51,10 +183,15 @@ func (item *CacheItem) AccessedOn() time.Time {
 	return item.accessedOn
 }
 
-// 获取item的创建时间
-func (item *CacheItem) CreatedOn() time.Time {
+// 获取item距离上次访问过了多久
+func (item *CacheItem) IdleTime() time.Duration {
 	item.RWMutex.RLock()
 	defer item.RWMutex.RUnlock()
+	return elapsed(time.Now(), item.accessedOn)
+}
+
+// 获取item的创建时间,createdOn构造后不再修改,不需要加锁
+func (item *CacheItem) CreatedOn() time.Time {
 	return item.createdOn
 }
 
@@ -65,11 +202,15 @@ func (item *CacheItem) AccessCount() int64 {
 	return item.accessCount
 }
 
+// 获取item的key,key构造后不再修改,不需要加锁
 func (item *CacheItem) Key() interface{} {
 	return item.key
 }
 
+// 获取item的数据
 func (item *CacheItem) Data() interface{} {
+	item.RWMutex.RLock()
+	defer item.RWMutex.RUnlock()
 	return item.data
 }
 
@@ -85,12 +226,89 @@ func (item *CacheItem) SetAboutToExpireCallback(f func(interface{})) {
 
 func (item *CacheItem) AddAboutToExpireCallback(f func(interface{})) {
 	item.RWMutex.Lock()
-	item.RWMutex.Unlock()
+	defer item.RWMutex.Unlock()
 	item.aboutToExpire = append(item.aboutToExpire, f)
 }
 
+// 获取已注册的aboutToExpire回调数量
+func (item *CacheItem) AboutToExpireCount() int {
+	item.RWMutex.RLock()
+	defer item.RWMutex.RUnlock()
+	return len(item.aboutToExpire)
+}
+
 func (item *CacheItem) RemoveAboutToExpireCallback() {
 	item.RWMutex.Lock()
 	defer item.RWMutex.Unlock()
 	item.aboutToExpire = nil
 }
+
+// 设置每次通过Value读到这个item时调用的回调,在KeepAlive之后、table的锁之外调用,不更新访问时间的读取(比如Peek)不会调用;f为nil表示取消
+func (item *CacheItem) SetOnAccessCallback(f func(item *CacheItem)) {
+	item.RWMutex.Lock()
+	defer item.RWMutex.Unlock()
+	item.onAccess = f
+}
+
+// 设置外部的到期时间来源,比如JWT的exp,设置后到期检查用f返回的时间代替lifeSpan,f为nil表示取消
+// 绝对存活时间和table的maxAge仍然有效;f在持有item的锁时调用,需要足够快且不能访问这个item
+// 直接修改item不会重新安排table的到期检查,item在table中时请用CacheTable.SetDeadlineFunc
+func (item *CacheItem) SetDeadlineFunc(f func() time.Time) {
+	item.RWMutex.Lock()
+	defer item.RWMutex.Unlock()
+	item.deadlineFunc = f
+}
+
+// 调用onAccess回调
+func (item *CacheItem) accessed() {
+	item.RWMutex.RLock()
+	f := item.onAccess
+	item.RWMutex.RUnlock()
+	if f != nil {
+		f(item)
+	}
+}
+
+// 计算item距离到期还剩多久,空闲上限(或deadlineFunc)、绝对上限和table的maxAge哪个先到算哪个
+// 第二个返回值为false表示item永不过期
+func (item *CacheItem) remaining(now time.Time, maxAge time.Duration) (time.Duration, bool) {
+	item.RWMutex.RLock()
+	defer item.RWMutex.RUnlock()
+	return item.remainingLocked(now, maxAge)
+}
+
+// 同remaining,调用方需持有item的锁
+func (item *CacheItem) remainingLocked(now time.Time, maxAge time.Duration) (time.Duration, bool) {
+	var d time.Duration
+	ok := false
+	if item.deadlineFunc != nil {
+		d = item.deadlineFunc().Sub(now)
+		ok = true
+	} else if item.lifeSpan > 0 {
+		d = item.lifeSpan - elapsed(now, item.accessedOn)
+		ok = true
+	}
+	for _, limit := range []time.Duration{item.absoluteLifeSpan, maxAge} {
+		if limit <= 0 {
+			continue
+		}
+		if abs := limit - elapsed(now, item.createdOn); !ok || abs < d {
+			d = abs
+		}
+		ok = true
+	}
+	return d, ok
+}
+
+// 在后台goroutine中执行finalizer,不管从哪条路径移除,只会执行一次
+func (item *CacheItem) finalize() {
+	item.RWMutex.RLock()
+	f, data := item.finalizer, item.data
+	item.RWMutex.RUnlock()
+	if f == nil {
+		return
+	}
+	item.finalizeOnce.Do(func() {
+		go f(data)
+	})
+}
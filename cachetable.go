@@ -1,26 +1,87 @@
 package cache2go
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"math"
+	"reflect"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type CacheTable struct {
+	// 锁竞争统计,放在结构体开头保证64位原子操作在32位平台上对齐
+	lockAcquisitions int64 // 加锁次数
+	lockContended    int64 // 需要等待才拿到锁的次数
+	lockWaitTime     int64 // 累计等待时间(纳秒)
+	lockProfiling    int32 // 是否开启锁竞争统计,默认关闭
+	// 原子维护的item数量,供IsEmpty/ApproxCount免锁读取
+	itemCount int64
+	// Value命中/未命中次数
+	hits   int64
+	misses int64
+	// Value遇到已经到期但还没被清理的item的次数
+	staleHits int64
+	// 按淘汰策略淘汰的item数量
+	evictions int64
+	// item增删的次数,用于判断MostAccessed的缓存是否失效
+	churn int64
+	// MostAccessed实际排序的次数
+	rankSorts int64
+	// 最近一次访问table的时间(相对monoBase的单调时钟纳秒数)和table的空闲存活时间,配合Namespace.tableCheck使用
+	lastAccess int64
+	tableTTL   int64
+	// loadData的调用次数、累计耗时和最长耗时(纳秒)
+	loadCount   int64
+	loadTime    int64
+	maxLoadTime int64
+
 	sync.RWMutex
 
 	// table 表名
 	name string
-	// 以map的方式存储所有的item
-	items map[interface{}]*CacheItem
+	// table所属的Namespace
+	namespace *Namespace
+	// 存储所有的item,默认是一个map
+	items itemStore
 
 	// 定时器,配合cleanupInterval触发expirationCheck函数达到缓存到期清理的作用
-	cleanupTimer *time.Timer
+	cleanupTimer Timer
+	// 设置定时器用的调度器,nil表示使用time.AfterFunc
+	scheduler Scheduler
 	// 触发下一次 到期检查(expirationCheck函数) 的时间间隔
 	cleanupInterval time.Duration
+	// item的最大存活时间,以createdOn为起点,不管lifeSpan和访问情况,0表示不限制
+	maxAge time.Duration
+	// 关闭到期机制,所有item都当作永不过期,也不再设置定时器
+	expirationDisabled bool
+	// 惰性到期,不设置定时器,访问时才删除到期的item
+	lazyExpiration bool
+	// 每个item两次KeepAlive生效的最小间隔
+	keepAliveThrottle time.Duration
+	// 最近一次和历史最长的到期检查耗时
+	lastCleanupDuration time.Duration
+	maxCleanupDuration  time.Duration
+	// 到期检查耗时超过slowCleanupThreshold时调用slowCleanup
+	slowCleanupThreshold time.Duration
+	slowCleanup          func(took time.Duration)
+	// 一次到期检查中删除回调的耗时预算,超出后剩下的回调放到后台执行,0表示不限制
+	callbackBudget time.Duration
 
+	// 保护logger和onLogError,日志可能在不持有table锁时输出
+	logMu  sync.RWMutex
 	logger *log.Logger
+	// 日志级别,低于这个级别的日志不输出
+	logLevel int32
+	// logger写入失败或panic时调用,nil表示忽略
+	onLogError func(err error)
 
 	// 访问不存在的item时,触发的回调函数
 	loadData func(key interface{}, args ...interface{}) *CacheItem
@@ -28,28 +89,238 @@ type CacheTable struct {
 	addedItem []func(item *CacheItem)
 	// 删除数据时,触发的回调函数
 	aboutToDeleteItem []func(item *CacheItem)
+	// 更新item的data时(UpdateValue等),触发的回调函数,oldData是更新前的data
+	updatedItem []func(item *CacheItem, oldData interface{})
+	// 每次到期检查后,一次性接收所有到期item的回调函数
+	batchExpire func(items []*CacheItem)
+
+	// 暂存最近到期item的墓地,nil表示未开启
+	graveyard *graveyard
+	// item之间的依赖关系
+	deps dependencyGraph
+
+	// 添加item时检查是否有"看起来相等"但==不相等的key
+	keyCollisionWarning bool
+	// 写入钩子,存储item前调用,可以替换data或者拒绝写入
+	onWrite func(key, data interface{}) (interface{}, error)
+	// 导出CSV时遇到非string的item是否报错
+	csvStrict bool
+	// table变空时通知WaitEmpty的条件变量
+	emptyCond *sync.Cond
+	// AddIdempotent最近处理过的操作id
+	opLog *opLog
+	// 是否把addedItem回调推迟到Add返回之后在后台执行
+	deferAddedCallbacks bool
+	// 等待执行的推迟回调,按Add的顺序由一个后台goroutine依次执行
+	deferredMu      sync.Mutex
+	deferred        []func()
+	deferredRunning bool
+	// 合并同一个key的并发加载
+	loads loadGroup
+	// loadData耗时超过slowLoadThreshold时调用slowLoad
+	slowLoadThreshold time.Duration
+	slowLoad          func(key interface{}, took time.Duration)
+	// 限制同时执行的loadData数量的信号量,nil表示不限制
+	loadSem chan struct{}
+	// 达到并发上限时直接返回ErrLoadConcurrencyExceeded,而不是等待
+	loadFailFast bool
+	// 布隆过滤器,nil表示未开启
+	bloom *bloomFilter
+	// item数量上限,超出时按淘汰策略淘汰,0表示不限制
+	maxItems int
+	// item的总成本上限和当前总成本,超出上限时和maxItems一样按淘汰策略淘汰,0表示不限制
+	maxCost   int64
+	totalCost int64
+	// 容量高低水位(占maxItems的比例)和高水位告警,watermarkFired表示已经告警过、等待回落
+	highWatermark   float64
+	lowWatermark    float64
+	onHighWatermark func(count, cap int)
+	watermarkFired  bool
+	// 最近一次分配给item的插入序号
+	insertSeq uint64
+	// 淘汰策略,默认是NewLRUPolicy;policyMu串行化对策略的调用(Touch是在读锁下调用的)
+	policy   EvictionPolicy
+	policyMu sync.Mutex
+	// 在Value命中时更新的TopKTracker
+	topK []*TopKTracker
+	// 按类型注册的编码和解码函数,见RegisterCodec
+	codecs map[string]codec
+
+	// MostAccessed排序结果的缓存
+	rankMu       sync.Mutex
+	rankInterval time.Duration
+	rankCache    CacheItemList
+	rankedOn     time.Time
+	rankChurn    int64
+
+	// 维护模式,开启时拒绝写入,读取不受影响
+	quiesced bool
+	// table已经关闭,写操作返回ErrTableClosed,读操作都是未命中
+	closed bool
+	// 按名字索引的二级索引
+	indexes map[string]*secondaryIndex
+	// 接收到期item的channel,table关闭时全部close
+	expiredChans []chan *CacheItem
+	// 时间轮到期机制,nil表示使用默认的定时器扫描
+	wheel *expirationWheel
+	// Value命中时校验item,返回false的item会被删除并当作未命中
+	valueValidator func(item *CacheItem) bool
+	// 判断两个data是否相同,AddChanged用它跳过没有变化的写入,nil表示使用reflect.DeepEqual
+	equal func(a, b interface{}) bool
+	// 延迟删除的宽限期,0表示删除时立即清理
+	deletionGrace time.Duration
+	// 已经逻辑删除、等待宽限期结束后清理的item
+	tombstones map[*CacheItem]struct{}
+
+	// 附加在table上的键值对,用单独的锁保护,持有table锁的回调(比如onWrite)里也可以读取
+	contextMu     sync.RWMutex
+	contextValues map[interface{}]interface{}
+}
+
+// 设置table的空闲存活时间,table超过d没有被访问(Cache/Add/Value/Delete)就会被关闭(清空并从Namespace中注销)
+// d<=0表示table永不过期
+func (table *CacheTable) SetTableTTL(d time.Duration) {
+	atomic.StoreInt64(&table.tableTTL, int64(d))
+	table.touch()
+	if table.namespace != nil {
+		table.namespace.tableCheck()
+	}
+}
+
+// 单调时钟的起点,table的访问时间记录为相对它的时长,不受系统时间回拨或跳变影响
+var monoBase = time.Now()
+
+// KeepAlive获取当前时间的函数,测试时替换成回拨过的时钟
+var clockNow = time.Now
+
+// 更新table的访问时间
+func (table *CacheTable) touch() {
+	atomic.StoreInt64(&table.lastAccess, int64(time.Since(monoBase)))
+}
+
+// 阻塞直到table中没有item,或者ctx被取消(返回ctx.Err())
+// 由删除/到期/清空时的条件变量唤醒,不是轮询
+func (table *CacheTable) WaitEmpty(ctx context.Context) error {
+	table.Lock()
+	defer table.Unlock()
+	if table.emptyCond == nil {
+		table.emptyCond = sync.NewCond(&table.RWMutex)
+	}
+
+	// ctx取消时唤醒等待者
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			table.Lock()
+			table.emptyCond.Broadcast()
+			table.Unlock()
+		case <-done:
+		}
+	}()
+
+	for table.items.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		table.emptyCond.Wait()
+	}
+	return nil
+}
+
+// table变空时唤醒WaitEmpty,调用方需持有写锁
+func (table *CacheTable) signalIfEmpty() {
+	if table.items.Len() == 0 && table.emptyCond != nil {
+		table.emptyCond.Broadcast()
+	}
 }
 
 // 查看table缓存了多少item
 func (table *CacheTable) Count() int {
 	table.RLock()
 	defer table.RUnlock()
-	return len(table.items)
+	return table.items.Len()
+}
+
+// 获取table中所有的key
+func (table *CacheTable) Keys() []interface{} {
+	table.RLock()
+	defer table.RUnlock()
+	r := make([]interface{}, 0, table.items.Len())
+	table.items.Range(func(k interface{}, _ *CacheItem) bool {
+		r = append(r, k)
+		return true
+	})
+	return r
+}
+
+// 不加锁判断table是否为空,适合频繁调用的存活探测
+func (table *CacheTable) IsEmpty() bool {
+	return atomic.LoadInt64(&table.itemCount) == 0
+}
+
+// 不加锁获取table中item的大致数量,并发增删时可能和Count()有短暂的偏差
+func (table *CacheTable) ApproxCount() int {
+	return int(atomic.LoadInt64(&table.itemCount))
 }
 
 // 为table中每一个item执行一次trans操作(这是个耗时操作,而且会长时间持有写锁,尽量避免使用)
 func (table *CacheTable) Foreach(trans func(key interface{}, item *CacheItem)) {
 	table.Lock()
 	defer table.Unlock()
-	for k, v := range table.items {
+	table.items.Range(func(k interface{}, v *CacheItem) bool {
 		trans(k, v)
+		return true
+	})
+}
+
+// 获取已注册的addedItem和aboutToDeleteItem回调数量,用于排查重复注册回调导致的泄漏
+func (table *CacheTable) CallbackCounts() (added, aboutToDelete int) {
+	table.RLock()
+	defer table.RUnlock()
+	return len(table.addedItem), len(table.aboutToDeleteItem)
+}
+
+// 不长时间持有锁的Foreach,f返回false时停止遍历
+// 先在读锁下拷贝所有key,再逐个短暂加锁取出item,遍历期间已经被删除的item会被跳过
+// f执行时不持有锁,可以在f中增删table;代价是看到的不是table在某一时刻的一致快照
+func (table *CacheTable) ForeachSafe(f func(key interface{}, item *CacheItem) bool) {
+	for _, key := range table.Keys() {
+		table.RLock()
+		item, ok := table.items.Get(key)
+		table.RUnlock()
+		if !ok {
+			continue
+		}
+		if !f(key, item) {
+			return
+		}
 	}
 }
 
-// 设置loadData
+// 在table上附加一个键值对,供回调和loadData读取共享的配置,比如租户id
+func (table *CacheTable) SetContextValue(key, value interface{}) {
+	table.contextMu.Lock()
+	defer table.contextMu.Unlock()
+	if table.contextValues == nil {
+		table.contextValues = make(map[interface{}]interface{})
+	}
+	table.contextValues[key] = value
+}
+
+// 获取SetContextValue附加的值
+func (table *CacheTable) ContextValue(key interface{}) (interface{}, bool) {
+	table.contextMu.RLock()
+	defer table.contextMu.RUnlock()
+	value, ok := table.contextValues[key]
+	return value, ok
+}
+
+// 设置loadData;开启了布隆过滤器时,只有过滤器中可能存在的key才会调用loadData,见EnableBloomFilter
 func (table *CacheTable) SetDataLoader(f func(interface{}, ...interface{}) *CacheItem) {
-	table.RWMutex.Lock()
-	defer table.RWMutex.Unlock()
+	table.Lock()
+	defer table.Unlock()
 	table.loadData = f
 }
 
@@ -58,23 +329,59 @@ func (table *CacheTable) SetAddedItemCallback(f func(item *CacheItem)) {
 	if len(table.addedItem) > 0 {
 		table.RemoveAddedItemCallbacks()
 	}
-	table.RWMutex.Lock()
-	defer table.RWMutex.Unlock()
+	table.Lock()
+	defer table.Unlock()
 	table.addedItem = append(table.addedItem, f)
 }
 
 func (table *CacheTable) AddAddedItemCallback(f func(item *CacheItem)) {
-	table.RWMutex.Lock()
-	defer table.RWMutex.Unlock()
+	table.Lock()
+	defer table.Unlock()
 	table.addedItem = append(table.addedItem, f)
 }
 
 func (table *CacheTable) RemoveAddedItemCallbacks() {
-	table.RWMutex.Lock()
-	defer table.RWMutex.Unlock()
+	table.Lock()
+	defer table.Unlock()
 	table.addedItem = nil
 }
 
+// 设置是否推迟执行addedItem回调
+// 开启后回调不再在Add内部执行,而是在Add返回之后由后台goroutine执行,回调中访问table不会有重入问题
+// 同一个table的回调按Add的顺序依次执行,回调执行时item已经在table中(除非之后又被删除)
+func (table *CacheTable) SetDeferAddedCallbacks(deferred bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.deferAddedCallbacks = deferred
+}
+
+// 把f放进推迟执行的队列,没有后台goroutine在执行时启动一个
+func (table *CacheTable) runDeferred(f func()) {
+	table.deferredMu.Lock()
+	table.deferred = append(table.deferred, f)
+	if table.deferredRunning {
+		table.deferredMu.Unlock()
+		return
+	}
+	table.deferredRunning = true
+	table.deferredMu.Unlock()
+
+	go func() {
+		for {
+			table.deferredMu.Lock()
+			if len(table.deferred) == 0 {
+				table.deferredRunning = false
+				table.deferredMu.Unlock()
+				return
+			}
+			f := table.deferred[0]
+			table.deferred = table.deferred[1:]
+			table.deferredMu.Unlock()
+			f()
+		}
+	}()
+}
+
 // aboutToDeleteItem的增删改
 func (table *CacheTable) SetAboutToDeleteItemCallback(f func(*CacheItem)) {
 	if len(table.aboutToDeleteItem) > 0 {
@@ -97,10 +404,32 @@ func (table *CacheTable) RemoveAboutToDeleteItemCallback() {
 	table.aboutToDeleteItem = nil
 }
 
+// updatedItem的增删改
+func (table *CacheTable) SetUpdatedItemCallback(f func(item *CacheItem, oldData interface{})) {
+	if len(table.updatedItem) > 0 {
+		table.RemoveUpdatedItemCallbacks()
+	}
+	table.Lock()
+	defer table.Unlock()
+	table.updatedItem = append(table.updatedItem, f)
+}
+
+func (table *CacheTable) AddUpdatedItemCallback(f func(item *CacheItem, oldData interface{})) {
+	table.Lock()
+	defer table.Unlock()
+	table.updatedItem = append(table.updatedItem, f)
+}
+
+func (table *CacheTable) RemoveUpdatedItemCallbacks() {
+	table.Lock()
+	defer table.Unlock()
+	table.updatedItem = nil
+}
+
 // 设置log的处理方式
 func (table *CacheTable) SetLogger(logger *log.Logger) {
-	table.RWMutex.Lock()
-	defer table.RWMutex.Unlock()
+	table.logMu.Lock()
+	defer table.logMu.Unlock()
 	table.logger = logger
 }
 
@@ -108,211 +437,1965 @@ func (table *CacheTable) SetLogger(logger *log.Logger) {
 // 遍历所有item,检查到期时间,删除到期的item
 // 更新 cleanupInterval
 func (table *CacheTable) expirationCheck() {
-	table.RWMutex.Lock()
+	table.Lock()
 	if table.cleanupTimer != nil {
 		table.cleanupTimer.Stop()
 	}
+	if table.expirationDisabled || table.lazyExpiration || table.closed || table.wheel != nil {
+		table.cleanupInterval = 0
+		table.Unlock()
+		return
+	}
 	if table.cleanupInterval > 0 {
-		table.log("Expiration check triggered after", table.cleanupInterval, "for table", table.name)
+		table.logDebug("Expiration check triggered after", table.cleanupInterval, "for table", table.name)
 	} else {
-		table.log("Expiration check installed for table", table.name)
+		table.logDebug("Expiration check installed for table", table.name)
 	}
 
 	now := time.Now()
 	smallestDuration := 0 * time.Second // 记录所有未到期的item中 最快要到期的时间间隔
-	for key, item := range table.items {
-		item.RWMutex.RLock()
-		lifeSpan := item.lifeSpan
-		accessedOn := item.accessedOn
-		item.RWMutex.RUnlock() // 读完数据后及时释放读锁
-
-		if lifeSpan == 0 { // lifeSpan为0的没有过期时间,不参与过期检查
+	pending := false                    // 是否还有会到期的item,永久item受maxAge限制时也算
+	var expired []*CacheItem            // 本次检查中到期的item
+	var spent time.Duration             // 本次检查中删除回调的累计耗时
+	var deferred []*CacheItem           // 超出回调预算、回调留到后台执行的item
+	var deferredDeps []interface{}      // deferred中的item需要级联删除的key
+	// deleteInternal执行回调时会临时释放锁,所以遍历的是item的拷贝
+	for _, item := range table.allItems() {
+		remaining, ok := item.remaining(now, table.maxAge)
+		if !ok { // 没有过期时间的item,不参与过期检查
 			continue
 		}
-		if now.Sub(accessedOn) > lifeSpan { // 过期了的item
-			table.deleteInternal(key)
+		if remaining < 0 { // 过期了的item
+			// 锁释放期间item可能已经被删除或者替换了
+			if cur, ok := table.items.Get(item.key); !ok || cur != item {
+				continue
+			}
+			if table.callbackBudget > 0 && spent >= table.callbackBudget {
+				// 回调耗时超出预算,先不触发回调直接移除,尽快完成本次检查
+				deferredDeps = append(deferredDeps, table.removeItem(item)...)
+				deferred = append(deferred, item)
+				expired = append(expired, item)
+				if table.graveyard != nil {
+					table.graveyard.bury(item, now)
+				}
+				table.publishExpired(item)
+				continue
+			}
+			start := time.Now()
+			r, err := table.deleteInternal(item.key)
+			spent += time.Since(start)
+			if err == nil {
+				expired = append(expired, r)
+				if table.graveyard != nil {
+					table.graveyard.bury(r, now)
+				}
+				table.publishExpired(r)
+			}
 		} else {
-			if smallestDuration == 0 || lifeSpan-now.Sub(accessedOn) < smallestDuration {
-				smallestDuration = lifeSpan - now.Sub(accessedOn)
+			if !pending || remaining < smallestDuration {
+				smallestDuration = remaining
 			}
+			pending = true
 		}
 	}
 
 	// 设置下次触发 到期检查 的时间及回调函数(expirationCheck函数)
+	// 剩余时间恰好为0的item也要再检查一次,不能因为间隔为0就不再调度
+	if pending && smallestDuration <= 0 {
+		smallestDuration = time.Nanosecond
+	}
 	table.cleanupInterval = smallestDuration
-	if smallestDuration > 0 {
-		table.cleanupTimer = time.AfterFunc(smallestDuration, func() {
+	if pending {
+		table.cleanupTimer = table.afterFunc(smallestDuration, func() {
 			go table.expirationCheck()
 		})
 	}
-	table.RWMutex.Unlock()
-}
+	batchExpire := table.batchExpire
 
-// 供内部使用 table中添加item
-func (table *CacheTable) addInternal(item *CacheItem) {
-	table.log("Adding item with key", item.key, "and lifespan of", item.lifeSpan, "to table", table.name)
-	table.items[item.key] = item
+	// 记录本次检查的耗时
+	took := time.Since(now)
+	table.lastCleanupDuration = took
+	if took > table.maxCleanupDuration {
+		table.maxCleanupDuration = took
+	}
+	slowCleanup := table.slowCleanup
+	slow := slowCleanup != nil && took > table.slowCleanupThreshold
+	aboutToDeleteItem := table.aboutToDeleteItem
+	if len(deferred) > 0 {
+		table.logDebug("Deferring callbacks of", len(deferred), "expired items in table", table.name)
+	}
+	table.Unlock()
 
-	// 先把要访问的数据拿出来,尽快释放写锁
-	expDur := table.cleanupInterval
-	addedItem := table.addedItem
-	table.RWMutex.Unlock()
+	// 释放锁之后,把本次到期的item一次性交给批量回调
+	fireExpired := func() {
+		if batchExpire != nil && len(expired) > 0 {
+			batchExpire(expired)
+		}
+	}
+	if len(deferred) > 0 {
+		go func() {
+			for _, item := range deferred {
+				fireDeleted(aboutToDeleteItem, item)
+			}
+			table.deleteKeys(deferredDeps)
+			fireExpired()
+		}()
+	} else {
+		fireExpired()
+	}
+	if slow {
+		slowCleanup(took)
+	}
+}
 
-	// 调用 table.addedItem中的回调
-	if addedItem != nil {
-		for _, callback := range addedItem {
-			callback(item)
+// 获取一个接收到期item的channel,每个到期删除的item(包括惰性到期)都会发送一次
+// 发送不会阻塞,channel满了就丢弃;table关闭时channel会被close;可以多次调用,每次得到一个独立的channel
+func (table *CacheTable) ExpiredChannel(buffer int) <-chan *CacheItem {
+	ch := make(chan *CacheItem, buffer)
+	table.Lock()
+	defer table.Unlock()
+	if table.closed {
+		close(ch)
+		return ch
+	}
+	table.expiredChans = append(table.expiredChans, ch)
+	return ch
+}
+
+// 把到期的item发送给所有ExpiredChannel,调用方需持有写锁
+func (table *CacheTable) publishExpired(item *CacheItem) {
+	for _, ch := range table.expiredChans {
+		select {
+		case ch <- item:
+		default:
 		}
 	}
+}
 
-	// 检查新加的item是否会触发 到期检查
-	if (item.lifeSpan > 0) && (expDur == 0 || item.lifeSpan < expDur) {
-		table.expirationCheck()
+// 设置慢清理告警,到期检查耗时超过threshold时,在释放锁之后调用f
+func (table *CacheTable) SetSlowCleanupThreshold(threshold time.Duration, f func(took time.Duration)) {
+	table.Lock()
+	defer table.Unlock()
+	table.slowCleanupThreshold = threshold
+	table.slowCleanup = f
+}
+
+// 设置到期检查中删除回调的耗时预算:一次检查中回调累计耗时超过d后,剩下到期的item直接移除,
+// 它们的删除回调、级联删除和批量到期回调放到后台goroutine中执行(此时item已经不在table中),
+// 这样慢回调不会推迟下一次到期检查;d<=0表示不限制。时间轮模式下不生效
+func (table *CacheTable) SetCallbackBudget(d time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+	table.callbackBudget = d
+}
+
+// 关闭table的到期机制:忽略所有item的lifeSpan和maxAge,不再设置定时器也不再做到期检查
+// 适合只按容量淘汰的纯LRU缓存
+func (table *CacheTable) DisableExpiration() {
+	table.Lock()
+	defer table.Unlock()
+	table.expirationDisabled = true
+	table.cleanupInterval = 0
+	if table.cleanupTimer != nil {
+		table.cleanupTimer.Stop()
 	}
 }
 
-// 供外界使用 table中添加item
-func (table *CacheTable) Add(key interface{}, lifeSpan time.Duration, data interface{}) *CacheItem {
-	item := NewCacheItem(key, lifeSpan, data)
-	table.RWMutex.Lock()
-	table.addInternal(item)
-	return item
+// 进入维护模式,之后Add/Delete/UpdateValue等写操作返回ErrTableQuiesced,Value/Peek/Count等读操作不受影响
+// 到期清理不算写操作,维护期间照常进行;Add这类不返回错误的方法写入失败时返回nil
+func (table *CacheTable) Quiesce() {
+	table.Lock()
+	defer table.Unlock()
+	table.logInfo("Quiescing table", table.name)
+	table.quiesced = true
 }
 
-// 供内部使用 table中删除item
-func (table *CacheTable) deleteInternal(key interface{}) (*CacheItem, error) {
-	r, ok := table.items[key]
-	if !ok {
-		return nil, ErrKeyNotFound
+// 退出维护模式
+func (table *CacheTable) Unquiesce() {
+	table.Lock()
+	defer table.Unlock()
+	table.logInfo("Unquiescing table", table.name)
+	table.quiesced = false
+}
+
+// 判断table当前是否可以写入,调用方需持有锁
+func (table *CacheTable) writable() error {
+	if table.closed {
+		return ErrTableClosed
 	}
-	aboutToDeletItem := table.aboutToDeleteItem
-	table.RWMutex.Unlock()
-	// 触发table中删除item的回调
-	if aboutToDeletItem != nil {
-		for _, callback := range aboutToDeletItem {
-			callback(r)
-		}
+	if table.quiesced {
+		return ErrTableQuiesced
 	}
-	r.RWMutex.RLock()
-	// 触发item被删除的回调
-	if r.aboutToExpire != nil {
-		for _, callback := range r.aboutToExpire {
-			callback(key)
-		}
+	return nil
+}
+
+// 关闭table:清空所有item、停止定时器并从所属的Namespace中注销
+// 之后的写操作返回ErrTableClosed,读操作都是未命中,避免还持有旧引用的goroutine误用;重复关闭没有影响
+// 再用Cache()获取同名的table会得到一个新的table
+func (table *CacheTable) Close() {
+	table.Lock()
+	if table.closed {
+		table.Unlock()
+		return
 	}
-	r.RWMutex.RUnlock()
+	table.closed = true
+	table.logInfo("Closing table", table.name)
+	table.Unlock()
+	table.Flush()
+	table.Lock()
+	for _, ch := range table.expiredChans {
+		close(ch)
+	}
+	table.expiredChans = nil
+	if table.wheel != nil {
+		close(table.wheel.stop)
+		table.wheel = nil
+	}
+	table.Unlock()
+	if table.namespace != nil {
+		table.namespace.deregister(table)
+	}
+}
 
-	table.RWMutex.Lock() // deleteInternal函数外table.RWMutex先lock在unlock ,函数里面先unlock在lock,主要是为了减少持有锁的时间
-	table.log("Deleting item with key", key, "created on", r.createdOn, "and hit", r.accessCount, "times from table", table.name)
-	delete(table.items, key)
-	return r, nil
+// 判断table是否已经关闭
+func (table *CacheTable) IsClosed() bool {
+	table.RLock()
+	defer table.RUnlock()
+	return table.closed
 }
 
-// 供外界使用 table中删除item
-func (table *CacheTable) Delete(key interface{}) (*CacheItem, error) {
+// 设置KeepAlive节流,每个item的访问时间和访问次数在d内最多更新一次,合并热点key上的突发访问
+// 可以减少热点key的写锁竞争,代价是到期时间和访问次数会有最多d的误差;d<=0表示不节流
+func (table *CacheTable) SetKeepAliveThrottle(d time.Duration) {
 	table.Lock()
 	defer table.Unlock()
-	return table.deleteInternal(key)
+	table.keepAliveThrottle = d
+	for _, item := range table.allItems() {
+		atomic.StoreInt64(&item.keepAliveThrottle, int64(d))
+	}
 }
 
-// 判断该item是否在table中
-func (table *CacheTable) Exists(key interface{}) bool {
-	table.RWMutex.RLock()
-	defer table.RWMutex.RUnlock()
-	_, ok := table.items[key]
-	return ok
+// 设置table中所有item的最大存活时间,创建超过d的item在到期检查时一定会被删除,
+// 即使它一直被访问或者lifeSpan为0,d<=0表示不限制
+func (table *CacheTable) SetMaxAge(d time.Duration) {
+	table.Lock()
+	table.maxAge = d
+	table.Unlock()
+	table.expirationCheck()
 }
 
-// 缓存item了返回false  没有缓存就缓存一下返回true
-func (table *CacheTable) NotFoundAdd(key interface{}, lifeSpan time.Duration, data interface{}) bool {
-	table.RWMutex.Lock()
-	if _, ok := table.items[key]; ok {
-		table.RWMutex.Unlock()
-		return false
+// 设置批量到期回调,每次到期检查结束后,把这次到期的所有item一次性传给f(不在锁内调用)
+// 适合需要批量处理到期数据的场景,和每个item的aboutToExpire回调可以同时使用
+func (table *CacheTable) SetBatchExpireCallback(f func(items []*CacheItem)) {
+	table.Lock()
+	defer table.Unlock()
+	table.batchExpire = f
+}
+
+// 供内部使用 table中添加item
+// 调用方需持有写锁,函数返回前会释放写锁;onWrite拒绝写入时返回它的错误,不会存储item
+func (table *CacheTable) addInternal(item *CacheItem) error {
+	if err := table.writable(); err != nil {
+		table.Unlock()
+		return err
 	}
-	item := NewCacheItem(key, lifeSpan, data)
-	table.addInternal(item)
-	return true
+	if err := table.applyOnWrite(item); err != nil {
+		table.logInfo("Rejected item with key", item.key, "in table", table.name, err)
+		table.Unlock()
+		return err
+	}
+	table.addWritten(item)
+	return nil
 }
 
-// 查询缓存key
-func (table *CacheTable) Value(key interface{}, args ...interface{}) (*CacheItem, error) {
-	table.RWMutex.RLock()
-	r, ok := table.items[key]
-	loadData := table.loadData
-	table.RWMutex.RUnlock()
-	if ok {
-		// 更新时间,返回查询结果
-		r.KeepAlive()
-		return r, nil
+// 添加已经经过onWrite的item,调用方需持有写锁且table可写,函数返回前会释放写锁
+func (table *CacheTable) addWritten(item *CacheItem) {
+	table.logInfo("Adding item with key", item.key, "and lifespan of", item.LifeSpan(), "to table", table.name)
+	if table.keyCollisionWarning {
+		table.checkKeyCollision(item.key)
 	}
+	// 覆盖已有的item时,依赖它的item需要级联删除
+	var dependents []interface{}
+	if old, ok := table.items.Get(item.key); ok && old != item {
+		dependents = table.deps.takeDependents(item.key)
+	}
+	table.storeItem(item)
+	evict := table.evictionCandidates(item)
+	watermark := table.checkHighWatermark()
 
-	// 没有找到的情况
-	if loadData != nil {
-		item := loadData(key, args...)
-		if item != nil {
-			table.Add(item.key, item.lifeSpan, item.data)
-			return item, nil
+	// 先把要访问的数据拿出来,尽快释放写锁
+	expDur := table.cleanupInterval
+	maxAge := table.maxAge
+	noSweep := table.expirationDisabled || table.lazyExpiration || table.wheel != nil
+	addedItem := table.addedItem
+	deferAdded := table.deferAddedCallbacks
+	table.Unlock()
+
+	for _, d := range dependents {
+		table.Delete(d)
+	}
+	table.evict(evict)
+	if watermark != nil {
+		watermark()
+	}
+
+	// 调用 table.addedItem中的回调
+	table.fireAdded(addedItem, deferAdded, item)
+
+	// 检查新加的item是否会触发 到期检查
+	if noSweep {
+		return
+	}
+	if remaining, ok := item.remaining(time.Now(), maxAge); ok && (expDur == 0 || remaining < expDur) {
+		table.expirationCheck()
+	}
+}
+
+// 对item调用addedItem回调,deferred为true时推迟到后台执行,调用方不能持有锁
+func (table *CacheTable) fireAdded(addedItem []func(item *CacheItem), deferred bool, item *CacheItem) {
+	if addedItem == nil {
+		return
+	}
+	run := func() {
+		for _, callback := range addedItem {
+			callback(item)
 		}
-		return nil, ErrKeyNotFoundOrLoadable
 	}
-	return nil, ErrKeyNotFound
+	if deferred {
+		table.runDeferred(run)
+	} else {
+		run()
+	}
 }
 
-// 清除所有item
-func (table *CacheTable) Flush() {
-	table.RWMutex.Lock()
-	defer table.RWMutex.Unlock()
+// 设置写入钩子,item存储前用它的返回值替换data;返回错误时拒绝写入,什么都不存
+// 可用来做数据的规范化、压缩或者校验
+func (table *CacheTable) SetOnWrite(f func(key, data interface{}) (interface{}, error)) {
+	table.Lock()
+	defer table.Unlock()
+	table.onWrite = f
+}
 
-	table.log("Flushing table", table.name)
-	table.items = make(map[interface{}]*CacheItem)
-	table.cleanupInterval = 0
-	if table.cleanupTimer != nil {
-		table.cleanupTimer.Stop()
+// 对还未存储的item调用onWrite,调用方需持有写锁
+func (table *CacheTable) applyOnWrite(item *CacheItem) error {
+	if table.onWrite == nil {
+		return nil
 	}
+	data, err := table.onWrite(item.key, item.data)
+	if err != nil {
+		return err
+	}
+	item.data = data
+	return nil
 }
 
-// 为了排序而定义的结构
-type CacheItemPair struct {
-	Key         interface{}
-	AccessCount int64
+// 开启/关闭key冲突警告,开启后添加item时如果已有key和新key值相同但==不相等(例如int(1)和int64(1)),
+// 会通过logger打印警告,帮助排查这类查不到缓存的问题
+// 每次添加都要遍历所有key,只建议在调试时开启
+func (table *CacheTable) SetKeyCollisionWarning(enabled bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.keyCollisionWarning = enabled
 }
-type CacheItemList []CacheItemPair
-
-// 这三个函数为了实现sort.Sort()中参数的接口
-func (p CacheItemList) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
-func (p CacheItemList) Len() int      { return len(p) }
-// 这个控制排序大到小还是小到大    p[i].AccessCount > p[j].AccessCount 从大到小排   p[i].AccessCount < p[j].AccessCount 从小到大排
-func (p CacheItemList) Less(i, j int) bool { return p[i].AccessCount > p[j].AccessCount }
 
-// 从大到小取 count 个
-func (table *CacheTable) MostAccessed(count int64) []*CacheItem {
-	table.RWMutex.RLock()
-	defer table.RWMutex.RUnlock()
-	p := make(CacheItemList, len(table.items))
-	i := 0
-	for k, v := range table.items {
-		p[i] = CacheItemPair{Key: k, AccessCount: v.accessCount}
-		i++
+// 检查table中是否有和key"看起来相等"的其它key,调用方需持有锁
+func (table *CacheTable) checkKeyCollision(key interface{}) {
+	if _, ok := table.items.Get(key); ok {
+		return
 	}
-	sort.Sort(p)
-	var r []*CacheItem
-	c := int64(0)
-	for _, v := range p {
-		if c >= count {
-			break
-		}
-		if item, ok := table.items[v.Key]; ok {
-			r = append(r, item)
+	table.items.Range(func(k interface{}, _ *CacheItem) bool {
+		if keysLookEqual(k, key) {
+			table.logInfo(fmt.Sprintf("Warning: key %v (%T) collides with existing key %v (%T) in table %s", key, key, k, k, table.name))
 		}
-		c++
+		return true
+	})
+}
+
+// 判断两个==不相等的key是否值相同,例如类型不同的数字或者指向相同内容的不同指针
+func keysLookEqual(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !va.IsValid() || !vb.IsValid() {
+		return false
 	}
-	return r
+	if va.Type() == vb.Type() {
+		return reflect.DeepEqual(a, b)
+	}
+	if isNumber(va) && isNumber(vb) {
+		return fmt.Sprint(a) == fmt.Sprint(b)
+	}
+	if va.Kind() == vb.Kind() && vb.Type().ConvertibleTo(va.Type()) {
+		return reflect.DeepEqual(a, vb.Convert(va.Type()).Interface())
+	}
+	return false
 }
 
-func (table *CacheTable) log(v ...interface{}) {
-	if table.logger == nil {
-		return
+func isNumber(v reflect.Value) bool {
+	return isInt(v) || isUint(v) || isFloat(v)
+}
+
+// 把item存进map,调用方需持有写锁
+func (table *CacheTable) storeItem(item *CacheItem) {
+	atomic.StoreInt64(&item.keepAliveThrottle, int64(table.keepAliveThrottle))
+	table.insertSeq++
+	item.seq = table.insertSeq
+	atomic.AddInt64(&table.churn, 1)
+	old, ok := table.items.Get(item.key)
+	if !ok {
+		atomic.AddInt64(&table.itemCount, 1)
+	} else if old != item {
+		// 被覆盖的旧item也算移除
+		table.policyRemove(old)
+		table.totalCost -= old.cost
+		old.finalize()
+	}
+	if !ok || old != item {
+		table.totalCost += item.cost
+	}
+	table.items.Set(item.key, item)
+	table.policyAdd(item)
+	table.indexItem(item)
+	table.scheduleExpiration(item, time.Now())
+	if table.bloom != nil {
+		table.bloom.add(item.key)
+	}
+}
+
+// 供外界使用 table中添加item
+// 设置了onWrite且写入被拒绝时返回nil,需要拿到错误请用AddWithError
+func (table *CacheTable) Add(key interface{}, lifeSpan time.Duration, data interface{}) *CacheItem {
+	item, _ := table.AddWithError(key, lifeSpan, data)
+	return item
+}
+
+// 添加一个永不过期的item,等同于Add(key, 0, data),但意图更明确
+func (table *CacheTable) AddPermanent(key interface{}, data interface{}) *CacheItem {
+	return table.Add(key, 0, data)
+}
+
+// 和Add一样,写入被onWrite拒绝时返回它的错误
+func (table *CacheTable) AddWithError(key interface{}, lifeSpan time.Duration, data interface{}) (*CacheItem, error) {
+	item := NewCacheItem(key, lifeSpan, data)
+	table.touch()
+	table.Lock()
+	if err := table.addInternal(item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// 和Add一样,但key已经存在且data和传入的相同(见SetEqualFunc)时不替换item,只按lifeSpan续期,返回changed=false
+// 比较的是经过onWrite之后的data;没有变化时不会触发添加回调;table不可写或写入被onWrite拒绝时返回nil, false
+func (table *CacheTable) AddChanged(key interface{}, lifeSpan time.Duration, data interface{}) (item *CacheItem, changed bool) {
+	table.touch()
+	table.Lock()
+	if table.writable() != nil {
+		table.Unlock()
+		return nil, false
+	}
+	item = NewCacheItem(key, lifeSpan, data)
+	if err := table.applyOnWrite(item); err != nil {
+		table.logInfo("Rejected item with key", key, "in table", table.name, err)
+		table.Unlock()
+		return nil, false
+	}
+	if r, ok := table.items.Get(key); ok && !table.isStale(r) && table.dataEqual(r.Data(), item.data) {
+		now := time.Now()
+		r.Lock()
+		r.lifeSpan = lifeSpan
+		r.accessedOn = now
+		r.Unlock()
+		table.policyTouch(r)
+		table.scheduleExpiration(r, now)
+		expDur, maxAge := table.cleanupInterval, table.maxAge
+		noSweep := table.expirationDisabled || table.lazyExpiration || table.wheel != nil
+		table.logDebug("Renewed unchanged item with key", key, "in table", table.name)
+		table.Unlock()
+		// 和addInternal一样,只有续期后比当前的到期检查更早到期时才需要重新检查
+		if remaining, ok := r.remaining(now, maxAge); !noSweep && ok && (expDur == 0 || remaining < expDur) {
+			table.expirationCheck()
+		}
+		return r, false
+	}
+	table.addWritten(item)
+	return item, true
+}
+
+// 设置判断两个data是否相同的函数,f为nil表示恢复默认的reflect.DeepEqual
+// f在持有写锁时调用,不能访问table
+func (table *CacheTable) SetEqualFunc(f func(a, b interface{}) bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.equal = f
+}
+
+// 用table的相等函数比较两个data,调用方需持有锁
+func (table *CacheTable) dataEqual(a, b interface{}) bool {
+	if table.equal == nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return table.equal(a, b)
+}
+
+// 批量添加时的一条数据
+type BatchEntry struct {
+	Key      interface{}
+	LifeSpan time.Duration
+	Data     interface{}
+}
+
+// 批量添加item,每个item都会触发addedItem回调,被onWrite拒绝的位置返回nil
+// 设置了SetMaxItems时,在同一次持有写锁时按淘汰策略淘汰超出上限的item,批量插入结束时item数量不会超过上限;
+// 批量的大小超过上限时,批量中先插入的item也会被淘汰;被淘汰item的删除回调在释放锁之后调用
+func (table *CacheTable) AddBatch(entries []BatchEntry) []*CacheItem {
+	r := make([]*CacheItem, len(entries))
+	table.touch()
+	table.Lock()
+	if err := table.writable(); err != nil {
+		table.Unlock()
+		return r
+	}
+	var dependents []interface{}
+	for i, e := range entries {
+		item := NewCacheItem(e.Key, e.LifeSpan, e.Data)
+		if err := table.applyOnWrite(item); err != nil {
+			table.logInfo("Rejected item with key", item.key, "in table", table.name, err)
+			continue
+		}
+		table.logInfo("Adding item with key", item.key, "and lifespan of", item.LifeSpan(), "to table", table.name)
+		if table.keyCollisionWarning {
+			table.checkKeyCollision(item.key)
+		}
+		if old, ok := table.items.Get(item.key); ok && old != item {
+			dependents = append(dependents, table.deps.takeDependents(item.key)...)
+		}
+		table.storeItem(item)
+		r[i] = item
+	}
+	watermark := table.checkHighWatermark()
+	// 在释放锁之前按淘汰策略淘汰,删除回调等释放锁之后再调用
+	evicted := table.evictionCandidates(nil)
+	for _, item := range evicted {
+		table.logDebug("Evicting item with key", item.key, "from table", table.name)
+		dependents = append(dependents, table.removeItem(item)...)
+		atomic.AddInt64(&table.evictions, 1)
+	}
+	noSweep := table.expirationDisabled || table.lazyExpiration || table.wheel != nil
+	aboutToDeleteItem := table.aboutToDeleteItem
+	addedItem, deferAdded := table.addedItem, table.deferAddedCallbacks
+	table.Unlock()
+
+	for _, item := range evicted {
+		fireDeleted(aboutToDeleteItem, item)
+	}
+	table.deleteKeys(dependents)
+	if watermark != nil {
+		watermark()
+	}
+	expires := false
+	for _, item := range r {
+		if item != nil {
+			table.fireAdded(addedItem, deferAdded, item)
+			expires = expires || item.lifeSpan > 0
+		}
+	}
+	if expires && !noSweep {
+		table.expirationCheck()
+	}
+	return r
+}
+
+// 预热用的快速批量添加,适合启动时一次性灌入大量数据
+// 和AddBatch相比:只加一次写锁,不触发addedItem回调,也不逐个重排到期检查,全部插入后只做一次到期检查
+// 代价是插入期间其它读写都会被阻塞,依赖addedItem回调的逻辑也感知不到这些item
+func (table *CacheTable) Warm(entries []BatchEntry) {
+	table.touch()
+	now := time.Now()
+	expires := false
+	table.Lock()
+	if err := table.writable(); err != nil {
+		table.Unlock()
+		return
+	}
+	var dependents []interface{}
+	for _, e := range entries {
+		item := newCacheItemAt(e.Key, e.LifeSpan, e.Data, now)
+		if err := table.applyOnWrite(item); err != nil {
+			table.logInfo("Rejected item with key", item.key, "in table", table.name, err)
+			continue
+		}
+		if table.keyCollisionWarning {
+			table.checkKeyCollision(item.key)
+		}
+		// 和AddBatch一样,覆盖已有的item时级联删除依赖它的item
+		if old, ok := table.items.Get(item.key); ok && old != item {
+			dependents = append(dependents, table.deps.takeDependents(item.key)...)
+		}
+		table.storeItem(item)
+		expires = expires || e.LifeSpan > 0
+	}
+	table.logInfo("Warmed table", table.name, "with", len(entries), "items")
+	evict := table.evictionCandidates(nil)
+	watermark := table.checkHighWatermark()
+	table.Unlock()
+
+	table.deleteKeys(dependents)
+	table.evict(evict)
+	if watermark != nil {
+		watermark()
+	}
+	if expires {
+		table.expirationCheck()
+	}
+}
+
+// 供外界使用 table中添加同时带有绝对存活时间(ttl)和空闲时间(tti)的item,哪个先到期就按哪个删除
+// ttl以创建时间为起点,访问不会续期;tti以访问时间为起点,每次访问都会续期
+func (table *CacheTable) AddWithTTLandTTI(key interface{}, data interface{}, ttl, tti time.Duration) *CacheItem {
+	item := NewCacheItem(key, tti, data)
+	item.absoluteLifeSpan = ttl
+	table.touch()
+	table.Lock()
+	if table.addInternal(item) != nil {
+		return nil
+	}
+	return item
+}
+
+// 供外界使用 key由data计算得出,适用于按内容寻址的缓存,相同的data得到相同的key
+// keyFn为nil时,使用data的gob编码的fnv哈希作为key;data无法gob编码时返回nil
+func (table *CacheTable) AddAuto(data interface{}, lifeSpan time.Duration, keyFn func(interface{}) interface{}) *CacheItem {
+	var key interface{}
+	if keyFn != nil {
+		key = keyFn(data)
+	} else {
+		h, err := gobHash(data)
+		if err != nil {
+			table.logError("Can't compute key for data in table", table.name, err)
+			return nil
+		}
+		key = h
+	}
+	return table.Add(key, lifeSpan, data)
+}
+
+// 计算data的gob编码的fnv哈希
+func gobHash(data interface{}) (uint64, error) {
+	h := fnv.New64a()
+	if err := gob.NewEncoder(h).Encode(data); err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
+
+// 计算整个table内容的摘要,用于判断两次快照之间table有没有变化
+// 按key排序后依次哈希key和data,同样的内容多次计算(包括跨进程)结果相同,不影响访问统计
+// 基础类型直接按值哈希,其它类型的data需要能被gob编码,gob编码失败时退回到%#v,
+// 此时包含指针的data结果可能不稳定;map类型的gob编码顺序不固定,也不适合作为data
+func (table *CacheTable) Checksum() uint64 {
+	table.RLock()
+	items := table.allItems()
+	table.RUnlock()
+	sort.Slice(items, func(i, j int) bool {
+		return keyLess(items[i].key, items[j].key)
+	})
+
+	h := fnv.New64a()
+	for _, item := range items {
+		writeHashable(h, item.key)
+		writeHashable(h, item.Data())
+	}
+	return h.Sum64()
+}
+
+// 把v以确定的编码写入w
+func writeHashable(w io.Writer, v interface{}) {
+	switch v.(type) {
+	case nil, string, []byte, bool, int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, float32, float64:
+		fmt.Fprintf(w, "%T:%v;", v, v)
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		fmt.Fprintf(w, "%T:%#v;", v, v)
+		return
+	}
+	fmt.Fprintf(w, "%T:", v)
+	w.Write(buf.Bytes())
+	io.WriteString(w, ";")
+}
+
+// 供内部使用 table中删除item
+func (table *CacheTable) deleteInternal(key interface{}) (*CacheItem, error) {
+	r, ok := table.items.Get(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	aboutToDeletItem := table.aboutToDeleteItem
+	table.Unlock()
+	fireDeleted(aboutToDeletItem, r)
+
+	table.Lock() // deleteInternal函数外table.RWMutex先lock在unlock ,函数里面先unlock在lock,主要是为了减少持有锁的时间
+	// 回调期间锁是释放的,只有item还在table中时才真正删除,避免重复计数
+	if cur, ok := table.items.Get(key); ok && cur == r {
+		// 级联删除依赖这个key的item
+		for _, d := range table.removeItem(r) {
+			table.deleteInternal(d)
+		}
+	}
+	return r, nil
+}
+
+// 调用table的删除回调和item自己的删除回调,调用方不能持有table的锁
+func fireDeleted(aboutToDeleteItem []func(item *CacheItem), r *CacheItem) {
+	// 触发table中删除item的回调
+	for _, callback := range aboutToDeleteItem {
+		callback(r)
+	}
+	r.RWMutex.RLock()
+	// 触发item被删除的回调
+	for _, callback := range r.aboutToExpire {
+		callback(r.key)
+	}
+	r.RWMutex.RUnlock()
+}
+
+// 把item从table中移除,不触发回调,返回依赖它、需要级联删除的key,调用方需持有写锁且item还在table中
+func (table *CacheTable) removeItem(r *CacheItem) []interface{} {
+	dependents := table.detachItem(r)
+	table.retire(r)
+	return dependents
+}
+
+// 把item从table中摘下来但不清理它,返回依赖它的key,调用方需持有写锁
+func (table *CacheTable) detachItem(r *CacheItem) []interface{} {
+	key := r.key
+	table.logInfo("Deleting item with key", key, "created on", r.createdOn, "and hit", r.AccessCount(), "times from table", table.name)
+	table.items.Delete(key)
+	table.unindexKey(key)
+	table.policyRemove(r)
+	table.totalCost -= r.cost
+	atomic.AddInt64(&table.itemCount, -1)
+	atomic.AddInt64(&table.churn, 1)
+	table.signalIfEmpty()
+	table.rearmHighWatermark()
+	return table.deps.remove(key)
+}
+
+// 设置延迟删除:删除后item立即对所有读操作不可见,但要等grace之后才真正清理(调用finalizer)
+// 已经拿到item的读者在宽限期内可以安全地继续使用它的data;grace<=0表示删除时立即清理
+func (table *CacheTable) SetDeferredDeletion(grace time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+	table.deletionGrace = grace
+}
+
+// 获取已经删除、还在宽限期内等待清理的item数量
+func (table *CacheTable) TombstoneCount() int {
+	table.RLock()
+	defer table.RUnlock()
+	return len(table.tombstones)
+}
+
+// 清理已经从table中删除的item,开启了延迟删除时等宽限期过后再清理,调用方需持有写锁
+func (table *CacheTable) retire(item *CacheItem) {
+	if table.deletionGrace <= 0 {
+		item.finalize()
+		return
+	}
+	if table.tombstones == nil {
+		table.tombstones = make(map[*CacheItem]struct{})
+	}
+	table.tombstones[item] = struct{}{}
+	table.afterFunc(table.deletionGrace, func() {
+		table.Lock()
+		delete(table.tombstones, item)
+		table.Unlock()
+		item.finalize()
+	})
+}
+
+// 供外界使用 table中删除item
+func (table *CacheTable) Delete(key interface{}) (*CacheItem, error) {
+	table.touch()
+	table.Lock()
+	defer table.Unlock()
+	if err := table.writable(); err != nil {
+		return nil, err
+	}
+	return table.deleteInternal(key)
+}
+
+// 为item设置finalizer,item从table中移除时(删除/到期/清空/覆盖)会在后台goroutine中调用一次
+// 适合释放item持有的文件句柄、数据库连接等资源
+func (table *CacheTable) SetFinalizer(key interface{}, f func(data interface{})) error {
+	table.RLock()
+	r, ok := table.items.Get(key)
+	table.RUnlock()
+	if !ok {
+		return ErrKeyNotFound
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.finalizer = f
+	return nil
+}
+
+// 只增加item的访问次数而不更新访问时间,用于人为调整MostAccessed的排序(例如预热)
+func (table *CacheTable) BumpAccessCount(key interface{}, delta int64) error {
+	table.RLock()
+	r, ok := table.items.Get(key)
+	table.RUnlock()
+	if !ok {
+		return ErrKeyNotFound
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.accessCount = saturatingAdd(r.accessCount, delta)
+	return nil
+}
+
+// 计数器:key的计数加1并返回新值,距离计数器创建超过window时重新从1开始计数,用于实现按时间窗口限流
+// 计数器是data为int64的item,window同时作为它的绝对存活时间;整个过程持有写锁,table不可写时返回和其他写操作相同的错误
+// key已有的data不是int64时返回ErrNotInt64Entry,不会覆盖它
+func (table *CacheTable) HitCounter(key interface{}, window time.Duration) (int64, error) {
+	table.touch()
+	table.Lock()
+	if err := table.writable(); err != nil {
+		table.Unlock()
+		return 0, err
+	}
+	if r, ok := table.items.Get(key); ok {
+		r.Lock()
+		n, isCounter := r.data.(int64)
+		if !isCounter {
+			r.Unlock()
+			table.Unlock()
+			return 0, ErrNotInt64Entry
+		}
+		if time.Since(r.createdOn) < window {
+			n++
+			r.data = n
+			r.Unlock()
+			table.Unlock()
+			return n, nil
+		}
+		r.Unlock()
+	}
+	item := NewCacheItem(key, 0, int64(1))
+	item.absoluteLifeSpan = window
+	if err := table.addInternal(item); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// 把key的int64数据减去delta并返回新值,减到<=0时删除item并返回deleted=true,用于引用计数
+// 减法和删除在同一次持有写锁时完成,并发调用时只有一次会删除;删除回调在item移除之后、释放锁之后调用
+// data不是int64时返回ErrNotInt64Entry
+func (table *CacheTable) DecrementAndMaybeDelete(key interface{}, delta int64) (newVal int64, deleted bool, err error) {
+	table.touch()
+	table.Lock()
+	if err := table.writable(); err != nil {
+		table.Unlock()
+		return 0, false, err
+	}
+	r, ok := table.items.Get(key)
+	if !ok {
+		table.Unlock()
+		return 0, false, ErrKeyNotFound
+	}
+	r.Lock()
+	n, isInt := r.data.(int64)
+	if !isInt {
+		r.Unlock()
+		table.Unlock()
+		return 0, false, ErrNotInt64Entry
+	}
+	n -= delta
+	r.data = n
+	r.Unlock()
+	if n > 0 {
+		table.Unlock()
+		return n, false, nil
+	}
+	dependents := table.removeItem(r)
+	aboutToDeleteItem := table.aboutToDeleteItem
+	table.Unlock()
+	fireDeleted(aboutToDeleteItem, r)
+	table.deleteKeys(dependents)
+	return n, true, nil
+}
+
+// 把oldKey改名为newKey,newKey已存在时返回ErrKeyExists
+func (table *CacheTable) Rename(oldKey, newKey interface{}) error {
+	return table.RenameWith(oldKey, newKey, nil)
+}
+
+// 把oldKey改名为newKey,newKey已存在时由onConflict决定留下哪个item(dst、src或者合并出的新item)
+// 整个过程持有写锁,oldKey最后一定会被删除;没有留下的item会触发finalizer,不会触发删除回调
+// 依赖被丢弃的item的key会像Delete一样被级联删除,留下的src的依赖关系转移到newKey
+// onConflict为nil时遇到冲突返回ErrKeyExists
+func (table *CacheTable) RenameWith(oldKey, newKey interface{}, onConflict func(dst, src *CacheItem) *CacheItem) error {
+	table.touch()
+	table.Lock()
+	if err := table.writable(); err != nil {
+		table.Unlock()
+		return err
+	}
+	src, ok := table.items.Get(oldKey)
+	if !ok {
+		table.Unlock()
+		return ErrKeyNotFound
+	}
+	if oldKey == newKey {
+		table.Unlock()
+		return nil
+	}
+	keep := src
+	dst, dstExists := table.items.Get(newKey)
+	if dstExists {
+		if onConflict == nil {
+			table.Unlock()
+			return ErrKeyExists
+		}
+		if keep = onConflict(dst, src); keep == nil {
+			keep = dst
+		}
+	}
+
+	table.logInfo("Renaming item with key", oldKey, "to", newKey, "in table", table.name)
+	table.items.Delete(oldKey)
+	table.unindexKey(oldKey)
+	table.policyRemove(src)
+	table.totalCost -= src.cost
+	atomic.AddInt64(&table.itemCount, -1)
+	var dependents []interface{}
+	if dstExists && keep != dst {
+		dependents = append(dependents, table.deps.remove(newKey)...)
+	}
+	if keep == dst {
+		dependents = append(dependents, table.deps.remove(oldKey)...)
+	} else {
+		table.deps.rename(oldKey, newKey)
+	}
+	if keep != src {
+		src.finalize()
+	}
+	if keep.key != newKey {
+		keep = keep.withKey(newKey)
+	}
+	table.storeItem(keep)
+	// 冲突时两个item合并成一个,和删除一样维护空table通知和高水位告警
+	table.signalIfEmpty()
+	table.rearmHighWatermark()
+	expDur, maxAge := table.cleanupInterval, table.maxAge
+	table.Unlock()
+
+	table.deleteKeys(dependents)
+	// 合并出的新item可能比当前的到期检查更早到期
+	if remaining, ok := keep.remaining(time.Now(), maxAge); ok && (expDur == 0 || remaining < expDur) {
+		table.expirationCheck()
+	}
+	return nil
+}
+
+// 原子地取出oldKey的item并以newKey写入新的数据,用于凭证轮换之类的场景
+// 删除和写入在同一次持有写锁时完成,并发的读者只会看到旧item或新item,不会两者都看不到
+// 和Delete/Add一样触发删除和添加的回调(在释放锁之后),依赖oldKey的item会被级联删除
+func (table *CacheTable) Rotate(oldKey, newKey interface{}, newData interface{}, lifeSpan time.Duration) (*CacheItem, error) {
+	item := NewCacheItem(newKey, lifeSpan, newData)
+	table.touch()
+	table.Lock()
+	if err := table.writable(); err != nil {
+		table.Unlock()
+		return nil, err
+	}
+	old, ok := table.items.Get(oldKey)
+	if !ok {
+		table.Unlock()
+		return nil, ErrKeyNotFound
+	}
+	if err := table.applyOnWrite(item); err != nil {
+		table.Unlock()
+		return nil, err
+	}
+
+	table.logInfo("Rotating item with key", oldKey, "to", newKey, "in table", table.name)
+	dependents := table.deps.remove(oldKey)
+	if oldKey != newKey {
+		if _, ok := table.items.Get(newKey); ok {
+			dependents = append(dependents, table.deps.takeDependents(newKey)...)
+		}
+		table.items.Delete(oldKey)
+		table.unindexKey(oldKey)
+		table.policyRemove(old)
+		table.totalCost -= old.cost
+		atomic.AddInt64(&table.itemCount, -1)
+		old.finalize()
+	}
+	table.storeItem(item)
+
+	expDur, maxAge := table.cleanupInterval, table.maxAge
+	noSweep := table.expirationDisabled || table.lazyExpiration || table.wheel != nil
+	aboutToDeleteItem := table.aboutToDeleteItem
+	addedItem := table.addedItem
+	deferAdded := table.deferAddedCallbacks
+	table.Unlock()
+
+	for _, callback := range aboutToDeleteItem {
+		callback(old)
+	}
+	old.RWMutex.RLock()
+	aboutToExpire := old.aboutToExpire
+	old.RWMutex.RUnlock()
+	for _, callback := range aboutToExpire {
+		callback(oldKey)
+	}
+	for _, d := range dependents {
+		table.Delete(d)
+	}
+	table.fireAdded(addedItem, deferAdded, item)
+
+	if noSweep {
+		return old, nil
+	}
+	if remaining, ok := item.remaining(time.Now(), maxAge); ok && (expDur == 0 || remaining < expDur) {
+		table.expirationCheck()
+	}
+	return old, nil
+}
+
+// 把满足pred的item移动到dst,返回移动的数量,用于冷热分层、归档等场景
+// 两个table按固定的顺序加锁,移动是原子的;item原样移动,字段(包括访问时间和回调)都保留,也不会调用finalizer
+// 释放锁之后对src触发删除回调,对dst触发添加回调;pred在持有两个table的锁时调用,不能访问这两个table
+func (table *CacheTable) MoveWhere(dst *CacheTable, pred func(*CacheItem) bool) int {
+	if dst == table {
+		return 0
+	}
+	table.touch()
+	dst.touch()
+	// 和WithTables使用同样的加锁顺序,避免互相等待
+	ordered := lockOrder([]*CacheTable{table, dst})
+	first, second := ordered[0], ordered[1]
+	first.Lock()
+	second.Lock()
+	if table.writable() != nil || dst.writable() != nil {
+		second.Unlock()
+		first.Unlock()
+		return 0
+	}
+
+	var moved []*CacheItem
+	var srcDependents, dstDependents []interface{}
+	for _, item := range table.allItems() {
+		if !pred(item) {
+			continue
+		}
+		table.items.Delete(item.key)
+		table.unindexKey(item.key)
+		table.policyRemove(item)
+		table.totalCost -= item.cost
+		atomic.AddInt64(&table.itemCount, -1)
+		srcDependents = append(srcDependents, table.deps.remove(item.key)...)
+		if old, ok := dst.items.Get(item.key); ok && old != item {
+			dstDependents = append(dstDependents, dst.deps.takeDependents(item.key)...)
+		}
+		dst.storeItem(item)
+		moved = append(moved, item)
+	}
+	if len(moved) > 0 {
+		table.logInfo("Moved", len(moved), "items from table", table.name, "to", dst.name)
+	}
+	table.signalIfEmpty()
+	table.rearmHighWatermark()
+	evict := dst.evictionCandidates(nil)
+	watermark := dst.checkHighWatermark()
+	aboutToDeleteItem := table.aboutToDeleteItem
+	addedItem, deferAdded := dst.addedItem, dst.deferAddedCallbacks
+	second.Unlock()
+	first.Unlock()
+
+	for _, item := range moved {
+		for _, callback := range aboutToDeleteItem {
+			callback(item)
+		}
+		dst.fireAdded(addedItem, deferAdded, item)
+	}
+	table.deleteKeys(srcDependents)
+	dst.deleteKeys(dstDependents)
+	dst.evict(evict)
+	if watermark != nil {
+		watermark()
+	}
+	if len(moved) > 0 {
+		dst.expirationCheck()
+	}
+	return len(moved)
+}
+
+// item剩余寿命超过minRemaining时才把data替换掉,返回是否替换了;永不过期的item总是会替换
+// 避免给马上就要被清理的item做无用的更新
+func (table *CacheTable) UpdateIfFresh(key, data interface{}, minRemaining time.Duration) (bool, error) {
+	table.touch()
+	table.Lock()
+	if err := table.writable(); err != nil {
+		table.Unlock()
+		return false, err
+	}
+	r, ok := table.items.Get(key)
+	if !ok {
+		table.Unlock()
+		return false, ErrKeyNotFound
+	}
+	r.RLock()
+	remaining, expires := r.remainingLocked(time.Now(), table.maxAge)
+	r.RUnlock()
+	if expires && remaining <= minRemaining {
+		table.Unlock()
+		return false, nil
+	}
+	old, dependents, err := table.updateData(r, data)
+	updatedItem := table.updatedItem
+	table.Unlock()
+	if err != nil {
+		return false, err
+	}
+	table.deleteKeys(dependents)
+	fireUpdated(updatedItem, r, old)
+	return true, nil
+}
+
+// 替换item的data,保留原来的到期时间和访问统计
+func (table *CacheTable) UpdateValue(key, data interface{}) error {
+	table.touch()
+	table.Lock()
+	if err := table.writable(); err != nil {
+		table.Unlock()
+		return err
+	}
+	r, ok := table.items.Get(key)
+	if !ok {
+		table.Unlock()
+		return ErrKeyNotFound
+	}
+	old, dependents, err := table.updateData(r, data)
+	updatedItem := table.updatedItem
+	table.Unlock()
+	if err != nil {
+		return err
+	}
+	table.deleteKeys(dependents)
+	fireUpdated(updatedItem, r, old)
+	return nil
+}
+
+// 在item的锁内用f(当前data)的返回值替换data,用于原子地修改缓存的对象(比如往切片里追加元素)
+// 并发的Modify不会丢失更新,读者也不会看到修改了一半的状态;保留原来的到期时间和访问统计
+// f在持有写锁时调用,不能访问table;更新回调在释放锁之后调用
+func (table *CacheTable) Modify(key interface{}, f func(data interface{}) interface{}) (*CacheItem, error) {
+	table.touch()
+	table.Lock()
+	if err := table.writable(); err != nil {
+		table.Unlock()
+		return nil, err
+	}
+	r, ok := table.items.Get(key)
+	if !ok {
+		table.Unlock()
+		return nil, ErrKeyNotFound
+	}
+	r.Lock()
+	old := r.data
+	data := f(old)
+	if table.onWrite != nil {
+		var err error
+		if data, err = table.onWrite(key, data); err != nil {
+			r.Unlock()
+			table.Unlock()
+			return nil, err
+		}
+	}
+	r.data = data
+	r.Unlock()
+	table.indexItem(r)
+	table.logInfo("Modifying item with key", key, "in table", table.name)
+	dependents := table.deps.takeDependents(key)
+	updatedItem := table.updatedItem
+	table.Unlock()
+	table.deleteKeys(dependents)
+	fireUpdated(updatedItem, r, old)
+	return r, nil
+}
+
+// 在一次持有写锁的过程中批量更新:updates中存在于table且满足cond的key,把data替换为updates中的值
+// 返回每个key是否更新了,不存在、不满足cond或者被onWrite拒绝的key为false
+// cond在持有写锁时调用,不能访问table;更新回调在释放锁之后按key的顺序调用
+func (table *CacheTable) UpdateBatchIf(updates map[interface{}]interface{}, cond func(key interface{}, item *CacheItem) bool) map[interface{}]bool {
+	r := make(map[interface{}]bool, len(updates))
+	keys := make([]interface{}, 0, len(updates))
+	for key := range updates {
+		keys = append(keys, key)
+		r[key] = false
+	}
+	sort.Slice(keys, func(i, j int) bool { return keyLess(keys[i], keys[j]) })
+
+	table.touch()
+	table.Lock()
+	if table.writable() != nil {
+		table.Unlock()
+		return r
+	}
+	type applied struct {
+		item    *CacheItem
+		oldData interface{}
+	}
+	var done []applied
+	var dependents []interface{}
+	for _, key := range keys {
+		item, ok := table.items.Get(key)
+		if !ok || !cond(key, item) {
+			continue
+		}
+		old, deps, err := table.updateData(item, updates[key])
+		if err != nil {
+			continue
+		}
+		r[key] = true
+		done = append(done, applied{item, old})
+		dependents = append(dependents, deps...)
+	}
+	updatedItem := table.updatedItem
+	table.Unlock()
+
+	table.deleteKeys(dependents)
+	for _, a := range done {
+		fireUpdated(updatedItem, a.item, a.oldData)
+	}
+	return r
+}
+
+// 替换已存储item的data,会经过onWrite,返回原来的data和依赖这个key的key,调用方需持有table的写锁
+// 和覆盖一样,依赖这个key的key需要在释放锁之后删除
+func (table *CacheTable) updateData(item *CacheItem, data interface{}) (interface{}, []interface{}, error) {
+	if table.onWrite != nil {
+		var err error
+		if data, err = table.onWrite(item.key, data); err != nil {
+			return nil, nil, err
+		}
+	}
+	item.Lock()
+	old := item.data
+	item.data = data
+	item.Unlock()
+	table.indexItem(item)
+	table.logInfo("Updating item with key", item.key, "in table", table.name)
+	return old, table.deps.takeDependents(item.key), nil
+}
+
+// 调用updatedItem回调,调用方不能持有锁
+func fireUpdated(updatedItem []func(item *CacheItem, oldData interface{}), item *CacheItem, oldData interface{}) {
+	for _, callback := range updatedItem {
+		callback(item, oldData)
+	}
+}
+
+// 设置item的访问时间并重新安排到期检查,用于从持久化数据中恢复时保留原来的到期进度
+func (table *CacheTable) SetAccessedOn(key interface{}, t time.Time) error {
+	table.RLock()
+	r, ok := table.items.Get(key)
+	if ok {
+		r.SetAccessedOn(t)
+	}
+	table.RUnlock()
+	if !ok {
+		return ErrKeyNotFound
+	}
+	table.expirationCheck()
+	return nil
+}
+
+// item的剩余寿命不足within时,把它的到期时间推迟extendBy并返回true,否则返回false
+// 空闲上限和绝对上限都会延长extendBy;table的maxAge是统一的上限,不会因此延长;永不过期的item总是返回false
+func (table *CacheTable) ExtendIfExpiringSoon(key interface{}, within, extendBy time.Duration) (bool, error) {
+	table.touch()
+	table.RLock()
+	r, ok := table.items.Get(key)
+	if !ok {
+		table.RUnlock()
+		return false, ErrKeyNotFound
+	}
+	r.RWMutex.Lock()
+	remaining, expiring := r.remainingLocked(time.Now(), table.maxAge)
+	extend := expiring && remaining < within
+	if extend {
+		if r.lifeSpan > 0 {
+			r.lifeSpan += extendBy
+		}
+		if r.absoluteLifeSpan > 0 {
+			r.absoluteLifeSpan += extendBy
+		}
+	}
+	r.RWMutex.Unlock()
+	if extend {
+		table.logInfo("Extended item with key", key, "by", extendBy, "in table", table.name)
+	}
+	table.RUnlock()
+
+	if extend {
+		table.expirationCheck()
+	}
+	return extend, nil
+}
+
+// 设置item的外部到期时间来源,并重新安排到期检查,见CacheItem.SetDeadlineFunc
+func (table *CacheTable) SetDeadlineFunc(key interface{}, f func() time.Time) error {
+	table.RLock()
+	r, ok := table.items.Get(key)
+	if ok {
+		r.SetDeadlineFunc(f)
+	}
+	table.RUnlock()
+	if !ok {
+		return ErrKeyNotFound
+	}
+	table.expirationCheck()
+	return nil
+}
+
+// 判断该item是否在table中
+func (table *CacheTable) Exists(key interface{}) bool {
+	table.RLock()
+	r, ok := table.items.Get(key)
+	stale := ok && table.isStale(r)
+	table.RUnlock()
+	if stale {
+		table.removeStale(key, r)
+		return false
+	}
+	return ok
+}
+
+// 开启惰性到期:不再设置定时器做到期检查,到期的item在Value/Exists/Lookup访问到时才删除
+// 省掉了后台定时器,代价是一直没人访问的到期item会一直占着内存
+func (table *CacheTable) SetLazyExpiration(lazy bool) {
+	table.Lock()
+	table.lazyExpiration = lazy
+	table.cleanupInterval = 0
+	if table.cleanupTimer != nil {
+		table.cleanupTimer.Stop()
+		table.cleanupTimer = nil
+	}
+	table.Unlock()
+	if !lazy {
+		table.expirationCheck()
+	}
+}
+
+// 惰性到期模式下item是否已经到期,调用方需持有锁
+func (table *CacheTable) isStale(item *CacheItem) bool {
+	return table.lazyExpiration && table.pastDeadline(item)
+}
+
+// 判断item是否已经过了到期时间,不管有没有被清理,调用方需持有锁
+func (table *CacheTable) pastDeadline(item *CacheItem) bool {
+	if table.expirationDisabled {
+		return false
+	}
+	remaining, ok := item.remaining(time.Now(), table.maxAge)
+	return ok && remaining < 0
+}
+
+// 设置Value命中时的校验函数,f返回false的item会被删除,这次查询当作未命中处理(设置了loadData时会重新加载)
+// 用来从损坏的缓存数据中恢复;f在锁之外调用,f为nil表示取消校验
+func (table *CacheTable) SetValueValidator(f func(item *CacheItem) bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.valueValidator = f
+}
+
+// 删除没有通过校验的item
+func (table *CacheTable) removeInvalid(key interface{}, item *CacheItem) {
+	table.Lock()
+	defer table.Unlock()
+	if cur, ok := table.items.Get(key); ok && cur == item {
+		table.logInfo("Removing invalid item with key", key, "from table", table.name)
+		table.deleteInternal(key)
+	}
+}
+
+// 删除访问时发现已经到期的item
+func (table *CacheTable) removeStale(key interface{}, item *CacheItem) {
+	table.Lock()
+	defer table.Unlock()
+	if cur, ok := table.items.Get(key); ok && cur == item {
+		table.logDebug("Lazily expiring item with key", key, "in table", table.name)
+		if r, err := table.deleteInternal(key); err == nil {
+			if table.graveyard != nil {
+				table.graveyard.bury(r, time.Now())
+			}
+			table.publishExpired(r)
+		}
+	}
+}
+
+// 缓存item了返回false  没有缓存就缓存一下返回true(被onWrite拒绝时也返回false)
+func (table *CacheTable) NotFoundAdd(key interface{}, lifeSpan time.Duration, data interface{}) bool {
+	table.Lock()
+	if _, ok := table.items.Get(key); ok {
+		table.Unlock()
+		return false
+	}
+	item := NewCacheItem(key, lifeSpan, data)
+	return table.addInternal(item) == nil
+}
+
+// 查询缓存key
+func (table *CacheTable) Value(key interface{}, args ...interface{}) (*CacheItem, error) {
+	return table.ValueOpts(key, WithArgs(args...))
+}
+
+// 像map一样查询缓存key,命中时会KeepAlive(可以传NoTouch()),不会调用loadData
+func (table *CacheTable) Lookup(key interface{}, opts ...ValueOption) (*CacheItem, bool) {
+	r, err := table.ValueOpts(key, append(opts, NoLoad())...)
+	return r, err == nil
+}
+
+// 查询缓存key,不更新访问时间和访问次数,也不调用loadData
+func (table *CacheTable) Peek(key interface{}) (*CacheItem, error) {
+	return table.ValueOpts(key, NoTouch(), NoLoad())
+}
+
+// ValueOpts 的可选项
+type ValueOption func(*valueOptions)
+
+type valueOptions struct {
+	noTouch bool          // 命中时不调用KeepAlive
+	noLoad  bool          // 未命中时不调用loadData
+	args    []interface{} // 传给loadData的参数
+}
+
+// 命中时不更新访问时间和访问次数
+func NoTouch() ValueOption {
+	return func(o *valueOptions) { o.noTouch = true }
+}
+
+// 未命中时不调用loadData
+func NoLoad() ValueOption {
+	return func(o *valueOptions) { o.noLoad = true }
+}
+
+// 未命中时传给loadData的参数
+func WithArgs(args ...interface{}) ValueOption {
+	return func(o *valueOptions) { o.args = args }
+}
+
+// 按opts查询缓存key,不传opts时和Value的行为一致
+func (table *CacheTable) ValueOpts(key interface{}, opts ...ValueOption) (*CacheItem, error) {
+	var o valueOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	table.touch()
+
+	table.RLock()
+	loadData := table.loadData
+	if table.closed {
+		table.RUnlock()
+		atomic.AddInt64(&table.misses, 1)
+		return nil, ErrKeyNotFound
+	}
+	// 布隆过滤器判断一定不存在的key,不用查table也不用加载
+	if loadData != nil && !o.noLoad && table.bloom != nil && !table.bloom.mightContain(key) {
+		table.RUnlock()
+		atomic.AddInt64(&table.misses, 1)
+		return nil, ErrKeyNotFoundOrLoadable
+	}
+	r, ok := table.items.Get(key)
+	past := ok && table.pastDeadline(r)
+	if past {
+		// 已经到期但还没被清理的item,惰性到期时会当作未命中,否则仍然会返回
+		atomic.AddInt64(&table.staleHits, 1)
+	}
+	stale := past && table.lazyExpiration
+	if ok && !stale && !o.noTouch {
+		// 持有table的读锁时更新时间,保证续期的item此时还在table中,不会"复活"刚被删除的item
+		r.KeepAlive()
+		table.policyTouch(r)
+		for _, t := range table.topK {
+			t.record(key)
+		}
+	}
+	validator := table.valueValidator
+	table.RUnlock()
+	if stale {
+		table.removeStale(key, r)
+		ok = false
+	}
+	if ok && validator != nil && !validator(r) {
+		table.removeInvalid(key, r)
+		ok = false
+	}
+	if ok {
+		atomic.AddInt64(&table.hits, 1)
+		if !o.noTouch {
+			r.accessed()
+		}
+		return r, nil
+	}
+
+	// 没有找到的情况
+	atomic.AddInt64(&table.misses, 1)
+	if loadData != nil && !o.noLoad {
+		var item *CacheItem
+		var err error
+		if len(o.args) == 0 {
+			item, err = table.load(key, loadData)
+		} else {
+			// 带参数的加载结果和参数有关,不能和别的调用共享
+			item, err = table.callLoader(loadData, key, o.args...)
+			if item != nil && !item.skipsCache() {
+				table.Add(item.key, item.lifeSpan, item.data)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			return item, nil
+		}
+		return nil, ErrKeyNotFoundOrLoadable
+	}
+	return nil, ErrKeyNotFound
+}
+
+// 清除所有item
+func (table *CacheTable) Flush() {
+	table.Lock()
+	defer table.Unlock()
+
+	table.logInfo("Flushing table", table.name)
+	for _, item := range table.allItems() {
+		table.items.Delete(item.key)
+		table.unindexKey(item.key)
+		table.policyRemove(item)
+		item.finalize()
+	}
+	atomic.StoreInt64(&table.itemCount, 0)
+	table.totalCost = 0
+	table.rankMu.Lock()
+	table.rankCache = nil
+	table.rankMu.Unlock()
+	table.deps = dependencyGraph{}
+	table.signalIfEmpty()
+	table.rearmHighWatermark()
+	table.cleanupInterval = 0
+	if table.cleanupTimer != nil {
+		table.cleanupTimer.Stop()
+	}
+}
+
+// 获取空闲时间超过threshold的item,不会更新item的访问时间
+func (table *CacheTable) IdleItems(threshold time.Duration) []*CacheItem {
+	table.RLock()
+	defer table.RUnlock()
+	var r []*CacheItem
+	for _, item := range table.allItems() {
+		if item.IdleTime() > threshold {
+			r = append(r, item)
+		}
+	}
+	return r
+}
+
+// 获取创建时间晚于t的item,按创建时间排序,用于增量同步,不会更新item的访问时间
+// 惰性到期模式下已经到期但还没删除的item不会返回
+func (table *CacheTable) ItemsCreatedAfter(t time.Time) []*CacheItem {
+	table.RLock()
+	defer table.RUnlock()
+	var r []*CacheItem
+	for _, item := range table.allItems() {
+		if item.createdOn.After(t) && !table.isStale(item) {
+			r = append(r, item)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].createdOn.Before(r[j].createdOn)
+	})
+	return r
+}
+
+// 获取item按创建时间的排名,即table中比它更早创建的item数量,0表示最老的item
+// 创建时间相同时按加入table的顺序;需要遍历所有item,复杂度O(n),不会更新item的访问时间
+func (table *CacheTable) CreationRank(key interface{}) (int, error) {
+	table.RLock()
+	defer table.RUnlock()
+	r, ok := table.items.Get(key)
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	rank := 0
+	for _, item := range table.allItems() {
+		if item.createdOn.Before(r.createdOn) || (item.createdOn.Equal(r.createdOn) && item.seq < r.seq) {
+			rank++
+		}
+	}
+	return rank, nil
+}
+
+// 获取item下一次到期的时刻,空闲上限(或deadlineFunc)、绝对上限和table的maxAge哪个先到算哪个
+// 第二个返回值为false表示item永不过期(包括关闭了到期机制);不会更新item的访问时间
+func (table *CacheTable) NextExpiry(key interface{}) (time.Time, bool, error) {
+	table.RLock()
+	defer table.RUnlock()
+	r, ok := table.items.Get(key)
+	if !ok {
+		return time.Time{}, false, ErrKeyNotFound
+	}
+	if table.expirationDisabled {
+		return time.Time{}, false, nil
+	}
+	now := time.Now()
+	remaining, expires := r.remaining(now, table.maxAge)
+	if !expires {
+		return time.Time{}, false, nil
+	}
+	return now.Add(remaining), true, nil
+}
+
+// 获取剩余存活时间小于d的item,按剩余时间从短到长排序,用于批量预热,不会更新item的访问时间
+// 已经过了到期时间的item和永不过期的item不会返回
+func (table *CacheTable) ExpiringWithin(d time.Duration) []*CacheItem {
+	table.RLock()
+	defer table.RUnlock()
+	if table.expirationDisabled {
+		return nil
+	}
+	now := time.Now()
+	var r []*CacheItem
+	left := make(map[*CacheItem]time.Duration)
+	for _, item := range table.allItems() {
+		remaining, ok := item.remaining(now, table.maxAge)
+		if ok && remaining >= 0 && remaining < d {
+			r = append(r, item)
+			left[item] = remaining
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return left[r[i]] < left[r[j]]
+	})
+	return r
+}
+
+// 为了排序而定义的结构
+type CacheItemPair struct {
+	Key         interface{}
+	AccessCount int64
+}
+type CacheItemList []CacheItemPair
+
+// 这三个函数为了实现sort.Sort()中参数的接口
+func (p CacheItemList) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p CacheItemList) Len() int      { return len(p) }
+// 这个控制排序大到小还是小到大    p[i].AccessCount > p[j].AccessCount 从大到小排   p[i].AccessCount < p[j].AccessCount 从小到大排
+// 访问次数相同时按key从小到大排,保证结果是确定的
+func (p CacheItemList) Less(i, j int) bool {
+	if p[i].AccessCount != p[j].AccessCount {
+		return p[i].AccessCount > p[j].AccessCount
+	}
+	return keyLess(p[i].Key, p[j].Key)
+}
+
+// 比较两个key的大小:同类的整数、浮点数、字符串按值比较,其它情况按fmt.Sprint的结果比较
+func keyLess(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.IsValid() && vb.IsValid() {
+		switch {
+		case isInt(va) && isInt(vb):
+			return va.Int() < vb.Int()
+		case isUint(va) && isUint(vb):
+			return va.Uint() < vb.Uint()
+		case isFloat(va) && isFloat(vb):
+			return va.Float() < vb.Float()
+		case va.Kind() == reflect.String && vb.Kind() == reflect.String:
+			return va.String() < vb.String()
+		}
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isUint(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+func isFloat(v reflect.Value) bool {
+	return v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64
+}
+
+// 从大到小取 count 个,访问次数相同的按key从小到大排
+// 设置了SetRankingRefreshInterval时,间隔内重复调用会复用上次的排序结果
+func (table *CacheTable) MostAccessed(count int64) []*CacheItem {
+	table.RLock()
+	defer table.RUnlock()
+	p := table.ranking()
+	var r []*CacheItem
+	c := int64(0)
+	for _, v := range p {
+		if c >= count {
+			break
+		}
+		if item, ok := table.items.Get(v.Key); ok {
+			r = append(r, item)
+		}
+		c++
+	}
+	return r
+}
+
+// 设置MostAccessed排序结果的缓存时间,d内重复调用MostAccessed不会重新排序,d<=0表示不缓存
+// 缓存期间访问次数的变化不会反映到排序上;增删的item超过缓存时item数量的十分之一时缓存提前失效
+func (table *CacheTable) SetRankingRefreshInterval(d time.Duration) {
+	table.rankMu.Lock()
+	defer table.rankMu.Unlock()
+	table.rankInterval = d
+	table.rankCache = nil
+}
+
+// 获取按访问次数排好序的列表,调用方需持有读锁
+func (table *CacheTable) ranking() CacheItemList {
+	table.rankMu.Lock()
+	defer table.rankMu.Unlock()
+	churn := atomic.LoadInt64(&table.churn)
+	if table.rankCache != nil && time.Since(table.rankedOn) < table.rankInterval &&
+		(churn-table.rankChurn)*10 <= int64(len(table.rankCache)) {
+		return table.rankCache
+	}
+
+	p := make(CacheItemList, 0, table.items.Len())
+	table.items.Range(func(k interface{}, v *CacheItem) bool {
+		p = append(p, CacheItemPair{Key: k, AccessCount: v.AccessCount()})
+		return true
+	})
+	sort.Sort(p)
+	atomic.AddInt64(&table.rankSorts, 1)
+	if table.rankInterval > 0 {
+		table.rankCache, table.rankedOn, table.rankChurn = p, time.Now(), churn
+	}
+	return p
+}
+
+// Aggregate 的结果,Count为0时其它字段都是0
+type AggResult struct {
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+	Avg   float64
+}
+
+// 对extract从每个item中取出的数值做汇总,extract返回false的item不参与统计
+// 整个过程持有读锁,extract中不能修改table;不会更新item的访问时间
+func (table *CacheTable) Aggregate(extract func(*CacheItem) (float64, bool)) AggResult {
+	table.RLock()
+	defer table.RUnlock()
+	var r AggResult
+	table.items.Range(func(_ interface{}, item *CacheItem) bool {
+		x, ok := extract(item)
+		if !ok {
+			return true
+		}
+		if r.Count == 0 || x < r.Min {
+			r.Min = x
+		}
+		if r.Count == 0 || x > r.Max {
+			r.Max = x
+		}
+		r.Count++
+		r.Sum += x
+		return true
+	})
+	if r.Count > 0 {
+		r.Avg = r.Sum / float64(r.Count)
+	}
+	return r
+}
+
+// SortedItems 的排序字段
+type SortField int
+
+const (
+	SortByCreatedOn   SortField = iota // 创建时间
+	SortByAccessedOn                   // 最近访问时间
+	SortByAccessCount                  // 访问次数
+	SortByKey                          // key,数字和字符串按值比较,其它类型按fmt.Sprint的结果比较
+)
+
+// 获取按by排序的所有item,desc为true时从大到小,字段相同的按key从小到大排;不会更新item的访问时间
+func (table *CacheTable) SortedItems(by SortField, desc bool) []*CacheItem {
+	table.RLock()
+	items := table.allItems()
+	table.RUnlock()
+
+	type entry struct {
+		item        *CacheItem
+		accessedOn  time.Time
+		accessCount int64
+	}
+	es := make([]entry, len(items))
+	for i, item := range items {
+		item.RWMutex.RLock()
+		es[i] = entry{item: item, accessedOn: item.accessedOn, accessCount: item.accessCount}
+		item.RWMutex.RUnlock()
+	}
+	// 返回a和b按by比较的结果,-1/0/1
+	compare := func(a, b entry) int {
+		switch by {
+		case SortByCreatedOn:
+			return compareTime(a.item.createdOn, b.item.createdOn)
+		case SortByAccessedOn:
+			return compareTime(a.accessedOn, b.accessedOn)
+		case SortByAccessCount:
+			if a.accessCount != b.accessCount {
+				if a.accessCount < b.accessCount {
+					return -1
+				}
+				return 1
+			}
+		}
+		return 0
+	}
+	sort.Slice(es, func(i, j int) bool {
+		if c := compare(es[i], es[j]); c != 0 {
+			return (c < 0) != desc
+		}
+		if by == SortByKey && desc {
+			return keyLess(es[j].item.key, es[i].item.key)
+		}
+		return keyLess(es[i].item.key, es[j].item.key)
+	})
+
+	r := make([]*CacheItem, len(es))
+	for i, e := range es {
+		r[i] = e.item
+	}
+	return r
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// 按热度从高到低取 count 个,热度同时考虑访问次数和最近访问时间:
+// score = (accessCount + 1) * e^(-recencyWeight * 空闲秒数)
+// recencyWeight为0时等同于按访问次数排序,越大越偏向最近访问过的item(近似LFU/LRU的混合排序)
+func (table *CacheTable) HottestItems(count int64, recencyWeight float64) []*CacheItem {
+	table.RLock()
+	defer table.RUnlock()
+	type scored struct {
+		item  *CacheItem
+		score float64
+	}
+	p := make([]scored, 0, table.items.Len())
+	for _, v := range table.allItems() {
+		score := float64(v.AccessCount()+1) * math.Exp(-recencyWeight*v.IdleTime().Seconds())
+		p = append(p, scored{v, score})
+	}
+	sort.Slice(p, func(i, j int) bool {
+		if p[i].score != p[j].score {
+			return p[i].score > p[j].score
+		}
+		return keyLess(p[i].item.key, p[j].item.key)
+	})
+	var r []*CacheItem
+	for i := int64(0); i < count && i < int64(len(p)); i++ {
+		r = append(r, p[i].item)
+	}
+	return r
+}
+
+// 删除创建时间最早的n个item,会触发删除回调,返回实际删除的数量
+func (table *CacheTable) DeleteOldest(n int) int {
+	table.RLock()
+	items := table.allItems()
+	table.RUnlock()
+	sort.Slice(items, func(i, j int) bool { return items[i].createdOn.Before(items[j].createdOn) })
+
+	keys := make([]interface{}, 0, n)
+	for i := 0; i < n && i < len(items); i++ {
+		keys = append(keys, items[i].key)
+	}
+	return table.deleteKeys(keys)
+}
+
+// 删除访问次数最少的n个item,会触发删除回调,返回实际删除的数量
+func (table *CacheTable) DeleteLeastAccessed(n int) int {
+	table.RLock()
+	p := make(CacheItemList, 0, table.items.Len())
+	table.items.Range(func(k interface{}, v *CacheItem) bool {
+		p = append(p, CacheItemPair{Key: k, AccessCount: v.AccessCount()})
+		return true
+	})
+	table.RUnlock()
+	// MostAccessed的排序反过来就是从小到大
+	sort.Sort(sort.Reverse(p))
+
+	keys := make([]interface{}, 0, n)
+	for i := 0; i < n && i < len(p); i++ {
+		keys = append(keys, p[i].Key)
+	}
+	return table.deleteKeys(keys)
+}
+
+// 删除data和value相同(见SetEqualFunc)的所有item,会触发删除回调,返回实际删除的数量
+// 需要比较所有item,复杂度O(n)
+func (table *CacheTable) DeleteByValue(value interface{}) int {
+	table.touch()
+	table.Lock()
+	defer table.Unlock()
+	if table.writable() != nil {
+		return 0
+	}
+	c := 0
+	// deleteInternal执行回调时会临时释放锁,所以遍历的是item的拷贝
+	for _, item := range table.allItems() {
+		if !table.dataEqual(item.Data(), value) {
+			continue
+		}
+		// 锁释放期间item可能已经被删除或者替换了
+		if cur, ok := table.items.Get(item.key); !ok || cur != item {
+			continue
+		}
+		table.deleteInternal(item.key)
+		c++
+	}
+	return c
+}
+
+// 逐个删除keys,返回实际删除的数量
+func (table *CacheTable) deleteKeys(keys []interface{}) int {
+	c := 0
+	for _, key := range keys {
+		if _, err := table.Delete(key); err == nil {
+			c++
+		}
 	}
-	table.logger.Println(v...)
+	return c
 }
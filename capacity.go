@@ -0,0 +1,132 @@
+package cache2go
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// 设置table最多保存的item数量,超出时按淘汰策略删除item,默认删除最久没有访问的(LRU),n<=0表示不限制
+// 淘汰和普通删除一样会触发删除回调和finalizer;调小上限时立即淘汰多出的item
+func (table *CacheTable) SetMaxItems(n int) {
+	table.Lock()
+	table.maxItems = n
+	evict := table.evictionCandidates(nil)
+	table.Unlock()
+	table.evict(evict)
+}
+
+// 设置table中item的总成本上限,超出时按淘汰策略(默认LRU)删除item,直到总成本不超过上限,n<=0表示不限制
+// 成本由AddWithCost指定,其它方式添加的item成本为0;调小上限时立即淘汰
+// 刚添加的item不会被淘汰,它自己的成本超过上限时会淘汰其它所有item
+func (table *CacheTable) SetMaxCost(n int64) {
+	table.Lock()
+	table.maxCost = n
+	evict := table.evictionCandidates(nil)
+	table.Unlock()
+	table.evict(evict)
+}
+
+// 获取table的总成本上限,0表示不限制
+func (table *CacheTable) MaxCost() int64 {
+	table.RLock()
+	defer table.RUnlock()
+	return table.maxCost
+}
+
+// 获取table中所有item的总成本
+func (table *CacheTable) TotalCost() int64 {
+	table.RLock()
+	defer table.RUnlock()
+	return table.totalCost
+}
+
+// 添加一个带成本的item,成本用于SetMaxCost的淘汰,比如item占用的字节数
+func (table *CacheTable) AddWithCost(key interface{}, lifeSpan time.Duration, data interface{}, cost int64) *CacheItem {
+	item := NewCacheItem(key, lifeSpan, data)
+	item.cost = cost
+	table.touch()
+	table.Lock()
+	if table.addInternal(item) != nil {
+		return nil
+	}
+	return item
+}
+
+// 获取table的item数量上限,0表示不限制
+func (table *CacheTable) MaxItems() int {
+	table.RLock()
+	defer table.RUnlock()
+	return table.maxItems
+}
+
+// 设置容量高水位告警,item数量达到上限的fraction(比如0.9)时调用一次f,f在释放锁之后调用
+// 数量回落到低水位以下后重新生效,低水位默认和高水位相同,可以用SetLowWatermark设置
+// 没有用SetMaxItems设置上限时不会触发
+func (table *CacheTable) SetOnHighWatermark(fraction float64, f func(count, cap int)) {
+	table.Lock()
+	defer table.Unlock()
+	table.highWatermark = fraction
+	if table.lowWatermark == 0 || table.lowWatermark > fraction {
+		table.lowWatermark = fraction
+	}
+	table.onHighWatermark = f
+	table.watermarkFired = false
+}
+
+// 设置高水位告警重新生效的低水位,item数量低于上限的fraction时重新生效
+func (table *CacheTable) SetLowWatermark(fraction float64) {
+	table.Lock()
+	defer table.Unlock()
+	table.lowWatermark = fraction
+}
+
+// 检查是否越过高水位,越过时返回要在释放锁之后调用的函数,调用方需持有写锁
+func (table *CacheTable) checkHighWatermark() func() {
+	if table.onHighWatermark == nil || table.maxItems <= 0 || table.watermarkFired {
+		return nil
+	}
+	count, cap := table.items.Len(), table.maxItems
+	if count < int(math.Ceil(table.highWatermark*float64(cap))) {
+		return nil
+	}
+	table.watermarkFired = true
+	f := table.onHighWatermark
+	return func() { f(count, cap) }
+}
+
+// item数量回落到低水位以下时重新开启高水位告警,调用方需持有写锁
+func (table *CacheTable) rearmHighWatermark() {
+	if table.watermarkFired && table.items.Len() < int(math.Ceil(table.lowWatermark*float64(table.maxItems))) {
+		table.watermarkFired = false
+	}
+}
+
+// 超出数量上限或成本上限时选出要淘汰的item,keep不会被选中,调用方需持有锁
+func (table *CacheTable) evictionCandidates(keep *CacheItem) []*CacheItem {
+	over, excess := 0, int64(0)
+	if table.maxItems > 0 {
+		over = table.items.Len() - table.maxItems
+	}
+	if table.maxCost > 0 {
+		excess = table.totalCost - table.maxCost
+	}
+	if over <= 0 && excess <= 0 || table.policy == nil {
+		return nil
+	}
+	return table.policyCandidates(keep, over, excess)
+}
+
+// 删除被淘汰的item,调用方不能持有锁
+// 选出item之后锁释放过,只删除仍然在table中的同一个item,期间被重新添加的key不受影响
+func (table *CacheTable) evict(victims []*CacheItem) {
+	for _, item := range victims {
+		table.Lock()
+		if cur, ok := table.items.Get(item.key); ok && cur == item {
+			table.logDebug("Evicting item with key", item.key, "from table", table.name)
+			table.deleteInternal(item.key)
+			atomic.AddInt64(&table.evictions, 1)
+		}
+		table.Unlock()
+	}
+}
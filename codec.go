@@ -0,0 +1,76 @@
+package cache2go
+
+import "fmt"
+
+// 一种类型的编码和解码函数
+type codec struct {
+	enc func(interface{}) ([]byte, error)
+	dec func([]byte) (interface{}, error)
+}
+
+// 为一种类型注册编码和解码函数,用于ExportProtoCodecs/ImportProtoCodecs持久化不同类型的data
+// typeTag是这种类型用fmt的%T格式化得到的名字,比如"*main.User"、"[]int",导出时记录在ItemProto的类型标记里
+// string类型默认按原样编码,重复注册会覆盖之前的函数
+func (table *CacheTable) RegisterCodec(typeTag string, enc func(interface{}) ([]byte, error), dec func([]byte) (interface{}, error)) {
+	table.Lock()
+	defer table.Unlock()
+	if table.codecs == nil {
+		table.codecs = make(map[string]codec)
+	}
+	table.codecs[typeTag] = codec{enc: enc, dec: dec}
+}
+
+// 用注册的编码函数把table中的item导出为ItemProto,key和data按各自的类型选择编码函数
+// 有类型没有注册编码函数或者编码失败时返回错误
+func (table *CacheTable) ExportProtoCodecs() ([]*ItemProto, error) {
+	codecs := table.codecSnapshot()
+	var firstErr error
+	protos := table.ExportProto(func(v interface{}) ([]byte, string) {
+		typ := fmt.Sprintf("%T", v)
+		c, ok := codecs[typ]
+		if !ok {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%w: %s", ErrNoCodec, typ)
+			}
+			return nil, typ
+		}
+		b, err := c.enc(v)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return b, typ
+	})
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return protos, nil
+}
+
+// 导入ExportProtoCodecs导出的item,按记录的类型标记选择解码函数
+// 任何一个item解码失败时返回错误,不导入任何item;写入失败的处理和ImportProto相同
+func (table *CacheTable) ImportProtoCodecs(protos []*ItemProto) error {
+	codecs := table.codecSnapshot()
+	return table.ImportProto(protos, func(b []byte, typ string) (interface{}, error) {
+		c, ok := codecs[typ]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNoCodec, typ)
+		}
+		return c.dec(b)
+	})
+}
+
+// 复制一份注册的编码函数,加上默认的string编码
+func (table *CacheTable) codecSnapshot() map[string]codec {
+	table.RLock()
+	defer table.RUnlock()
+	r := map[string]codec{
+		"string": {
+			enc: func(v interface{}) ([]byte, error) { return []byte(v.(string)), nil },
+			dec: func(b []byte) (interface{}, error) { return string(b), nil },
+		},
+	}
+	for typ, c := range table.codecs {
+		r[typ] = c
+	}
+	return r
+}
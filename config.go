@@ -0,0 +1,97 @@
+package cache2go
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// table当前配置的快照,用于调试和测试断言;各字段的含义见对应的Set方法
+type TableConfig struct {
+	Name string
+
+	// 到期相关
+	MaxAge               time.Duration // SetMaxAge
+	TableTTL             time.Duration // SetTableTTL
+	ExpirationDisabled   bool          // DisableExpiration
+	LazyExpiration       bool          // SetLazyExpiration
+	WheelResolution      time.Duration // SetExpirationWheel,0表示没有使用时间轮
+	WheelSize            int
+	CleanupInterval      time.Duration // 当前距离下一次到期检查的间隔,0表示没有安排
+	KeepAliveThrottle    time.Duration // SetKeepAliveThrottle
+	SlowCleanupThreshold time.Duration // SetSlowCleanupThreshold
+	CallbackBudget       time.Duration // SetCallbackBudget
+	DeletionGrace        time.Duration // SetDeferredDeletion
+
+	// 容量相关
+	MaxItems          int     // SetMaxItems
+	MaxCost           int64   // SetMaxCost
+	HighWatermark     float64 // SetOnHighWatermark
+	LowWatermark      float64 // SetLowWatermark
+	HasEvictionPolicy bool    // SetEvictionPolicy设置了默认LRU以外的策略
+
+	// 加载相关
+	HasLoader          bool          // SetDataLoader
+	MaxConcurrentLoads int           // SetMaxConcurrentLoads,0表示不限制
+	LoadFailFast       bool          // SetMaxConcurrentLoads
+	SlowLoadThreshold  time.Duration // SetOnSlowLoad
+	BloomFilter        bool          // EnableBloomFilter
+
+	// 其它
+	LogLevel               LogLevel      // SetLogLevel
+	RankingRefreshInterval time.Duration // SetRankingRefreshInterval
+	DeferAddedCallbacks    bool          // SetDeferAddedCallbacks
+	KeyCollisionWarning    bool          // SetKeyCollisionWarning
+	CSVStrict              bool          // SetCSVStrict
+	GraveyardCapacity      int           // SetGraveyard,0表示没有开启
+	Indexes                []string      // AddIndex添加的索引名,按名字排序
+	Quiesced               bool          // Quiesce
+	Closed                 bool          // Close
+}
+
+// 获取table当前配置的快照,只读,修改返回值不会影响table
+func (table *CacheTable) Config() TableConfig {
+	table.RLock()
+	defer table.RUnlock()
+	c := TableConfig{
+		Name:                   table.name,
+		MaxAge:                 table.maxAge,
+		TableTTL:               time.Duration(atomic.LoadInt64(&table.tableTTL)),
+		ExpirationDisabled:     table.expirationDisabled,
+		LazyExpiration:         table.lazyExpiration,
+		CleanupInterval:        table.cleanupInterval,
+		KeepAliveThrottle:      table.keepAliveThrottle,
+		SlowCleanupThreshold:   table.slowCleanupThreshold,
+		CallbackBudget:         table.callbackBudget,
+		DeletionGrace:          table.deletionGrace,
+		MaxItems:               table.maxItems,
+		MaxCost:                table.maxCost,
+		HighWatermark:          table.highWatermark,
+		LowWatermark:           table.lowWatermark,
+		HasEvictionPolicy:      !isDefaultPolicy(table.policy),
+		HasLoader:              table.loadData != nil,
+		MaxConcurrentLoads:     cap(table.loadSem),
+		LoadFailFast:           table.loadFailFast,
+		SlowLoadThreshold:      table.slowLoadThreshold,
+		BloomFilter:            table.bloom != nil,
+		LogLevel:               LogLevel(atomic.LoadInt32(&table.logLevel)),
+		RankingRefreshInterval: table.rankInterval,
+		DeferAddedCallbacks:    table.deferAddedCallbacks,
+		KeyCollisionWarning:    table.keyCollisionWarning,
+		CSVStrict:              table.csvStrict,
+		Quiesced:               table.quiesced,
+		Closed:                 table.closed,
+	}
+	if table.wheel != nil {
+		c.WheelResolution = table.wheel.resolution
+		c.WheelSize = len(table.wheel.buckets)
+	}
+	if table.graveyard != nil {
+		c.GraveyardCapacity = table.graveyard.capacity
+	}
+	for name := range table.indexes {
+		c.Indexes = append(c.Indexes, name)
+	}
+	sort.Strings(c.Indexes)
+	return c
+}
@@ -0,0 +1,102 @@
+package cache2go
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// CSV文件的表头
+var csvHeader = []string{"key", "value", "createdOn", "accessCount"}
+
+// 设置导出CSV时遇到key或data不是string的item的处理方式
+// strict为true时返回ErrNotStringEntry,默认false直接跳过
+func (table *CacheTable) SetCSVStrict(strict bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.csvStrict = strict
+}
+
+// 把key和data都是string的item导出为CSV,列依次为key、value、createdOn、accessCount,按key排序
+func (table *CacheTable) ExportCSV(w io.Writer) error {
+	table.RLock()
+	strict := table.csvStrict
+	items := table.allItems()
+	table.RUnlock()
+
+	var rows [][]string
+	for _, item := range items {
+		key, ok1 := item.key.(string)
+		value, ok2 := item.Data().(string)
+		if !ok1 || !ok2 {
+			if strict {
+				return ErrNotStringEntry
+			}
+			continue
+		}
+		rows = append(rows, []string{
+			key,
+			value,
+			item.createdOn.Format(time.RFC3339Nano),
+			strconv.FormatInt(item.AccessCount(), 10),
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// 从ExportCSV导出的CSV中导入item,保留createdOn和accessCount,lifeSpan由参数指定
+// 解析失败或者table不可写时返回错误,不导入任何item;被onWrite拒绝的行跳过,导入其它行后返回第一个错误
+func (table *CacheTable) ImportCSV(r io.Reader, lifeSpan time.Duration) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(rows) > 0 && rows[0][0] == csvHeader[0] && rows[0][1] == csvHeader[1] {
+		rows = rows[1:]
+	}
+
+	items := make([]*CacheItem, 0, len(rows))
+	for _, row := range rows {
+		createdOn, err := time.Parse(time.RFC3339Nano, row[2])
+		if err != nil {
+			return err
+		}
+		accessCount, err := strconv.ParseInt(row[3], 10, 64)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		item := newCacheItemAt(row[0], lifeSpan, row[1], notAfter(createdOn, now))
+		item.accessedOn = now
+		item.accessCount = accessCount
+		items = append(items, item)
+	}
+
+	table.touch()
+	table.RLock()
+	err = table.writable()
+	table.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		table.Lock()
+		if e := table.addInternal(item); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package cache2go
+
+// item之间的依赖关系
+// dependents[a]是依赖a的key集合,a被删除或者更新时,这些key会被级联删除
+// dependsOn[b]是b依赖的key集合,用来在b被删除时清理反向的边
+type dependencyGraph struct {
+	dependents map[interface{}]map[interface{}]struct{}
+	dependsOn  map[interface{}]map[interface{}]struct{}
+}
+
+func (g *dependencyGraph) add(key, on interface{}) {
+	if g.dependents == nil {
+		g.dependents = make(map[interface{}]map[interface{}]struct{})
+		g.dependsOn = make(map[interface{}]map[interface{}]struct{})
+	}
+	addEdge(g.dependents, on, key)
+	addEdge(g.dependsOn, key, on)
+}
+
+// 沿着dependents能否从from走到to
+func (g *dependencyGraph) reachable(from, to interface{}) bool {
+	visited := map[interface{}]struct{}{}
+	stack := []interface{}{from}
+	for len(stack) > 0 {
+		cur := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if cur == to {
+			return true
+		}
+		if _, ok := visited[cur]; ok {
+			continue
+		}
+		visited[cur] = struct{}{}
+		for d := range g.dependents[cur] {
+			stack = append(stack, d)
+		}
+	}
+	return false
+}
+
+// 移除依赖key的所有边,返回依赖key的key
+func (g *dependencyGraph) takeDependents(key interface{}) []interface{} {
+	var r []interface{}
+	for d := range g.dependents[key] {
+		r = append(r, d)
+		removeEdge(g.dependsOn, d, key)
+	}
+	delete(g.dependents, key)
+	return r
+}
+
+// 把key从依赖图中彻底移除,返回依赖key的key
+func (g *dependencyGraph) remove(key interface{}) []interface{} {
+	for on := range g.dependsOn[key] {
+		removeEdge(g.dependents, on, key)
+	}
+	delete(g.dependsOn, key)
+	return g.takeDependents(key)
+}
+
+// 把key的所有边转移到newKey上,newKey原来不能有边
+func (g *dependencyGraph) rename(key, newKey interface{}) {
+	for on := range g.dependsOn[key] {
+		removeEdge(g.dependents, on, key)
+		addEdge(g.dependents, on, newKey)
+		addEdge(g.dependsOn, newKey, on)
+	}
+	delete(g.dependsOn, key)
+	for d := range g.dependents[key] {
+		removeEdge(g.dependsOn, d, key)
+		addEdge(g.dependsOn, d, newKey)
+		addEdge(g.dependents, newKey, d)
+	}
+	delete(g.dependents, key)
+}
+
+func addEdge(m map[interface{}]map[interface{}]struct{}, from, to interface{}) {
+	if m[from] == nil {
+		m[from] = make(map[interface{}]struct{})
+	}
+	m[from][to] = struct{}{}
+}
+
+func removeEdge(m map[interface{}]map[interface{}]struct{}, from, to interface{}) {
+	delete(m[from], to)
+	if len(m[from]) == 0 {
+		delete(m, from)
+	}
+}
+
+// 登记key依赖dependsOn,dependsOn被删除(包括到期)或者被重新Add覆盖时,key会被级联删除
+// 两个key都必须已经在table中;会形成循环依赖时返回ErrDependencyCycle,table不可写时返回和其他写操作相同的错误
+func (table *CacheTable) AddDependent(key, dependsOn interface{}) error {
+	table.Lock()
+	defer table.Unlock()
+	if err := table.writable(); err != nil {
+		return err
+	}
+	if _, ok := table.items.Get(key); !ok {
+		return ErrKeyNotFound
+	}
+	if _, ok := table.items.Get(dependsOn); !ok {
+		return ErrKeyNotFound
+	}
+	if key == dependsOn || table.deps.reachable(key, dependsOn) {
+		return ErrDependencyCycle
+	}
+	table.deps.add(key, dependsOn)
+	return nil
+}
@@ -5,6 +5,17 @@ import (
 )
 
 var (
-	ErrKeyNotFound           = errors.New("Key not found in cache")
-	ErrKeyNotFoundOrLoadable = errors.New("Key not found and could not be loaded into cache")
+	ErrKeyNotFound             = errors.New("Key not found in cache")
+	ErrKeyNotFoundOrLoadable   = errors.New("Key not found and could not be loaded into cache")
+	ErrKeyExists               = errors.New("Key already exists in cache")
+	ErrDependencyCycle         = errors.New("Dependency would create a cycle")
+	ErrNotStringEntry          = errors.New("Key or data is not a string")
+	ErrLoadConcurrencyExceeded = errors.New("Too many concurrent loads")
+	ErrTableQuiesced           = errors.New("Table is quiesced for maintenance")
+	ErrIndexNotFound           = errors.New("Index not found")
+	ErrTableClosed             = errors.New("Table is closed")
+	ErrNoCodec                 = errors.New("No codec registered for type")
+	ErrNotInt64Entry           = errors.New("Data is not an int64")
+	ErrTooManyTables           = errors.New("Too many tables")
+	ErrTableNotInTx            = errors.New("Table is not locked by this transaction")
 )
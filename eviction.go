@@ -0,0 +1,196 @@
+package cache2go
+
+import (
+	"container/list"
+	"sort"
+)
+
+// 淘汰策略:超出SetMaxItems的上限时由它决定淘汰哪个item,可以用来实现ARC、2Q、S3-FIFO等策略
+// table会在item加入、被访问、被移除时通知策略,所有调用都由table串行化,实现不需要自己加锁
+type EvictionPolicy interface {
+	// item加入table(包括覆盖已有的key)
+	Add(item *CacheItem)
+	// item通过Value等方法被访问
+	Touch(item *CacheItem)
+	// item从table中移除,item已经被Evict选中过时应当忽略
+	Remove(item *CacheItem)
+	// 选出要淘汰的item的key并不再跟踪它,没有可淘汰的item时返回nil
+	Evict() interface{}
+}
+
+// 设置淘汰策略,nil表示恢复默认的LRU(NewLRUPolicy);table中已有的item按加入顺序交给新策略
+// 设置后如果item数量超出上限,立即按新策略淘汰
+func (table *CacheTable) SetEvictionPolicy(p EvictionPolicy) {
+	table.Lock()
+	table.policyMu.Lock()
+	if p == nil {
+		p = NewLRUPolicy()
+	}
+	table.policy = p
+	items := table.allItems()
+	sort.Slice(items, func(i, j int) bool { return items[i].seq < items[j].seq })
+	for _, item := range items {
+		p.Add(item)
+	}
+	table.policyMu.Unlock()
+	evict := table.evictionCandidates(nil)
+	table.Unlock()
+	table.evict(evict)
+}
+
+// 以下三个方法把item的变化通知给淘汰策略,调用方需持有table的锁
+func (table *CacheTable) policyAdd(item *CacheItem) {
+	if table.policy == nil {
+		return
+	}
+	table.policyMu.Lock()
+	defer table.policyMu.Unlock()
+	table.policy.Add(item)
+}
+
+func (table *CacheTable) policyTouch(item *CacheItem) {
+	if table.policy == nil {
+		return
+	}
+	table.policyMu.Lock()
+	defer table.policyMu.Unlock()
+	table.policy.Touch(item)
+}
+
+func (table *CacheTable) policyRemove(item *CacheItem) {
+	if table.policy == nil {
+		return
+	}
+	table.policyMu.Lock()
+	defer table.policyMu.Unlock()
+	table.policy.Remove(item)
+}
+
+// 按淘汰策略选出要淘汰的item,直到淘汰了over个并且成本降低了excess,keep不会被选中,调用方需持有锁
+func (table *CacheTable) policyCandidates(keep *CacheItem, over int, excess int64) []*CacheItem {
+	table.policyMu.Lock()
+	defer table.policyMu.Unlock()
+	var victims []*CacheItem
+	skipped := false
+	for over > 0 || excess > 0 {
+		key := table.policy.Evict()
+		if key == nil {
+			break
+		}
+		item, ok := table.items.Get(key)
+		if !ok {
+			continue
+		}
+		if item == keep {
+			skipped = true
+			continue
+		}
+		victims = append(victims, item)
+		over--
+		excess -= item.cost
+	}
+	// keep被策略选中过,需要重新交给策略跟踪
+	if skipped {
+		table.policy.Add(keep)
+	}
+	return victims
+}
+
+// 是否是默认的LRU策略
+func isDefaultPolicy(p EvictionPolicy) bool {
+	_, ok := p.(*lruPolicy)
+	return p == nil || ok
+}
+
+// 最近最少使用(LRU)策略,淘汰最久没有被访问的item,访问时间相同时先淘汰先加入的
+// table默认使用这个策略,每次加入、访问和淘汰都是O(1)
+type lruPolicy struct {
+	order *list.List // 从旧到新
+	elems map[*CacheItem]*list.Element
+}
+
+// 创建LRU淘汰策略
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{order: list.New(), elems: make(map[*CacheItem]*list.Element)}
+}
+
+func (p *lruPolicy) Add(item *CacheItem) {
+	if e, ok := p.elems[item]; ok {
+		p.order.MoveToBack(e)
+		return
+	}
+	p.elems[item] = p.order.PushBack(item)
+}
+
+func (p *lruPolicy) Touch(item *CacheItem) {
+	if e, ok := p.elems[item]; ok {
+		p.order.MoveToBack(e)
+	}
+}
+
+func (p *lruPolicy) Remove(item *CacheItem) {
+	if e, ok := p.elems[item]; ok {
+		p.order.Remove(e)
+		delete(p.elems, item)
+	}
+}
+
+func (p *lruPolicy) Evict() interface{} {
+	e := p.order.Front()
+	if e == nil {
+		return nil
+	}
+	item := p.order.Remove(e).(*CacheItem)
+	delete(p.elems, item)
+	return item.key
+}
+
+// 最不经常使用(LFU)策略,淘汰访问次数最少的item,次数相同时淘汰先加入的
+// Evict需要遍历所有item,复杂度O(n)
+type lfuPolicy struct {
+	entries map[*CacheItem]*lfuEntry
+	seq     uint64
+}
+
+type lfuEntry struct {
+	hits int64
+	seq  uint64
+}
+
+// 创建LFU淘汰策略
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{entries: make(map[*CacheItem]*lfuEntry)}
+}
+
+func (p *lfuPolicy) Add(item *CacheItem) {
+	if _, ok := p.entries[item]; ok {
+		return
+	}
+	p.seq++
+	p.entries[item] = &lfuEntry{hits: item.AccessCount(), seq: p.seq}
+}
+
+func (p *lfuPolicy) Touch(item *CacheItem) {
+	if e, ok := p.entries[item]; ok {
+		e.hits = saturatingAdd(e.hits, 1)
+	}
+}
+
+func (p *lfuPolicy) Remove(item *CacheItem) {
+	delete(p.entries, item)
+}
+
+func (p *lfuPolicy) Evict() interface{} {
+	var victim *CacheItem
+	var min *lfuEntry
+	for item, e := range p.entries {
+		if min == nil || e.hits < min.hits || (e.hits == min.hits && e.seq < min.seq) {
+			victim, min = item, e
+		}
+	}
+	if victim == nil {
+		return nil
+	}
+	delete(p.entries, victim)
+	return victim.key
+}
@@ -1,4 +1,4 @@
 module xswwhy/cache2go
 
-go 1.16
+go 1.18
 
@@ -0,0 +1,61 @@
+package cache2go
+
+import "time"
+
+// 墓地:暂存最近到期的item,方便审计和调试
+// 容量和保留时间都有上限,超出容量时挤掉最早进来的item
+type graveyard struct {
+	capacity int
+	ttl      time.Duration
+	entries  []graveEntry
+}
+
+type graveEntry struct {
+	item     *CacheItem
+	buriedOn time.Time
+}
+
+// 把到期的item放进墓地
+func (g *graveyard) bury(item *CacheItem, now time.Time) {
+	g.prune(now)
+	if len(g.entries) >= g.capacity {
+		g.entries = g.entries[len(g.entries)-g.capacity+1:]
+	}
+	g.entries = append(g.entries, graveEntry{item: item, buriedOn: now})
+}
+
+// 清理超过保留时间的item
+func (g *graveyard) prune(now time.Time) {
+	i := 0
+	for i < len(g.entries) && g.ttl > 0 && now.Sub(g.entries[i].buriedOn) > g.ttl {
+		i++
+	}
+	g.entries = g.entries[i:]
+}
+
+// 开启墓地,item到期删除后会在墓地中保留ttl时间,最多保留capacity个
+// capacity<=0时关闭墓地;ttl为0表示只受容量限制
+func (table *CacheTable) SetGraveyard(capacity int, ttl time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+	if capacity <= 0 {
+		table.graveyard = nil
+		return
+	}
+	table.graveyard = &graveyard{capacity: capacity, ttl: ttl}
+}
+
+// 获取墓地中还没过保留时间的item,按到期先后排序
+func (table *CacheTable) Graveyard() []*CacheItem {
+	table.Lock()
+	defer table.Unlock()
+	if table.graveyard == nil {
+		return nil
+	}
+	table.graveyard.prune(time.Now())
+	r := make([]*CacheItem, 0, len(table.graveyard.entries))
+	for _, e := range table.graveyard.entries {
+		r = append(r, e.item)
+	}
+	return r
+}
@@ -0,0 +1,102 @@
+package cache2go
+
+import "time"
+
+// AddIdempotent默认记住的操作id数量和保留时间
+const (
+	defaultOpLogCapacity = 1024
+	defaultOpLogTTL      = time.Minute
+)
+
+// 最近处理过的操作id,容量和保留时间都有上限,超出容量时挤掉最早的记录
+type opLog struct {
+	capacity int
+	ttl      time.Duration
+	entries  []opEntry
+	seen     map[string]*CacheItem
+}
+
+type opEntry struct {
+	opID   string
+	seenOn time.Time
+}
+
+func newOpLog(capacity int, ttl time.Duration) *opLog {
+	return &opLog{capacity: capacity, ttl: ttl, seen: make(map[string]*CacheItem)}
+}
+
+// 查找opID对应的item
+func (l *opLog) get(opID string, now time.Time) (*CacheItem, bool) {
+	l.prune(now)
+	item, ok := l.seen[opID]
+	return item, ok
+}
+
+// 记录opID
+func (l *opLog) record(opID string, item *CacheItem, now time.Time) {
+	l.prune(now)
+	for len(l.entries) >= l.capacity {
+		delete(l.seen, l.entries[0].opID)
+		l.entries = l.entries[1:]
+	}
+	l.entries = append(l.entries, opEntry{opID: opID, seenOn: now})
+	l.seen[opID] = item
+}
+
+// 忘掉opID,写入失败时使用,让重试可以再次执行
+func (l *opLog) forget(opID string) {
+	delete(l.seen, opID)
+	for i, e := range l.entries {
+		if e.opID == opID {
+			l.entries = append(l.entries[:i], l.entries[i+1:]...)
+			break
+		}
+	}
+}
+
+// 清理超过保留时间的记录
+func (l *opLog) prune(now time.Time) {
+	i := 0
+	for i < len(l.entries) && l.ttl > 0 && now.Sub(l.entries[i].seenOn) > l.ttl {
+		delete(l.seen, l.entries[i].opID)
+		i++
+	}
+	l.entries = l.entries[i:]
+}
+
+// 设置AddIdempotent记住操作id的数量和保留时间,默认1024个、1分钟
+// ttl为0表示只受容量限制
+func (table *CacheTable) SetIdempotencyWindow(capacity int, ttl time.Duration) {
+	if capacity <= 0 {
+		capacity = defaultOpLogCapacity
+	}
+	table.Lock()
+	defer table.Unlock()
+	table.opLog = newOpLog(capacity, ttl)
+}
+
+// 带操作id的Add,用于会被重试的请求
+// opID最近已经处理过时不会重复添加,直接返回当时添加的item和false
+func (table *CacheTable) AddIdempotent(key interface{}, lifeSpan time.Duration, data interface{}, opID string) (*CacheItem, bool) {
+	now := time.Now()
+	table.touch()
+	table.Lock()
+	if table.opLog == nil {
+		table.opLog = newOpLog(defaultOpLogCapacity, defaultOpLogTTL)
+	}
+	if item, ok := table.opLog.get(opID, now); ok {
+		table.Unlock()
+		return item, false
+	}
+
+	item := newCacheItemAt(key, lifeSpan, data, now)
+	// 先记录再写入,并发的重试也只会有一个真正执行
+	table.opLog.record(opID, item, now)
+	if err := table.addInternal(item); err != nil {
+		table.Lock()
+		table.opLog.forget(opID)
+		table.Unlock()
+		return nil, false
+	}
+	return item, true
+}
@@ -0,0 +1,108 @@
+package cache2go
+
+import "sort"
+
+// 二级索引,按extract从item中取出的值反查item
+type secondaryIndex struct {
+	extract func(*CacheItem) (interface{}, bool)
+	// 索引值 -> key -> item
+	entries map[interface{}]map[interface{}]*CacheItem
+	// key -> 索引值
+	keys map[interface{}]interface{}
+}
+
+func (idx *secondaryIndex) add(item *CacheItem) {
+	idx.remove(item.key)
+	indexKey, ok := idx.extract(item)
+	if !ok {
+		return
+	}
+	if idx.entries[indexKey] == nil {
+		idx.entries[indexKey] = make(map[interface{}]*CacheItem)
+	}
+	idx.entries[indexKey][item.key] = item
+	idx.keys[item.key] = indexKey
+}
+
+func (idx *secondaryIndex) remove(key interface{}) {
+	indexKey, ok := idx.keys[key]
+	if !ok {
+		return
+	}
+	delete(idx.keys, key)
+	delete(idx.entries[indexKey], key)
+	if len(idx.entries[indexKey]) == 0 {
+		delete(idx.entries, indexKey)
+	}
+}
+
+// 添加名为name的二级索引,extract从item中取出索引值,返回false的item不进索引
+// 索引在添加、删除、到期、更新data时自动维护,已有的item会立即建立索引
+// extract在持有table写锁时调用,不能访问table
+func (table *CacheTable) AddIndex(name string, extract func(*CacheItem) (indexKey interface{}, ok bool)) {
+	table.Lock()
+	defer table.Unlock()
+	idx := &secondaryIndex{
+		extract: extract,
+		entries: make(map[interface{}]map[interface{}]*CacheItem),
+		keys:    make(map[interface{}]interface{}),
+	}
+	for _, item := range table.allItems() {
+		idx.add(item)
+	}
+	if table.indexes == nil {
+		table.indexes = make(map[string]*secondaryIndex)
+	}
+	table.indexes[name] = idx
+}
+
+// 删除名为name的二级索引
+func (table *CacheTable) RemoveIndex(name string) {
+	table.Lock()
+	defer table.Unlock()
+	delete(table.indexes, name)
+}
+
+// 通过二级索引查询item,按key排序,命中的item会KeepAlive;和Value一样,惰性到期时跳过已经到期的item
+// 索引不存在时返回ErrIndexNotFound,没有匹配的item或者table已经关闭时返回ErrKeyNotFound
+func (table *CacheTable) ValueByIndex(name string, indexKey interface{}) ([]*CacheItem, error) {
+	table.touch()
+	table.RLock()
+	defer table.RUnlock()
+	if table.closed {
+		return nil, ErrKeyNotFound
+	}
+	idx, ok := table.indexes[name]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	entries := idx.entries[indexKey]
+	r := make([]*CacheItem, 0, len(entries))
+	for _, item := range entries {
+		if table.isStale(item) {
+			continue
+		}
+		item.KeepAlive()
+		table.policyTouch(item)
+		r = append(r, item)
+	}
+	if len(r) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	sort.Slice(r, func(i, j int) bool { return keyLess(r[i].key, r[j].key) })
+	return r, nil
+}
+
+// 更新所有索引中item的索引值,调用方需持有写锁
+func (table *CacheTable) indexItem(item *CacheItem) {
+	for _, idx := range table.indexes {
+		idx.add(item)
+	}
+}
+
+// 从所有索引中移除key,调用方需持有写锁
+func (table *CacheTable) unindexKey(key interface{}) {
+	for _, idx := range table.indexes {
+		idx.remove(key)
+	}
+}
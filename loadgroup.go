@@ -0,0 +1,190 @@
+package cache2go
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 合并同一个key的并发加载,同一时刻每个key只有一个loadData在执行,其它调用等待并共享结果
+type loadGroup struct {
+	mu    sync.Mutex
+	calls map[interface{}]*loadCall
+}
+
+type loadCall struct {
+	wg   sync.WaitGroup
+	item *CacheItem
+	err  error
+}
+
+// 执行key的加载函数fn,已有同一个key的加载在进行时等待它的结果
+func (g *loadGroup) do(key interface{}, fn func() (*CacheItem, error)) (*CacheItem, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[interface{}]*loadCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.item, c.err
+	}
+	c := new(loadCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.item, c.err = fn()
+	return c.item, c.err
+}
+
+// 通过loadData加载key并写入table,并发加载同一个key时只会调用一次loadData
+func (table *CacheTable) load(key interface{}, loadData func(key interface{}, args ...interface{}) *CacheItem) (*CacheItem, error) {
+	return table.loads.do(key, func() (*CacheItem, error) {
+		// 前一次加载可能刚刚完成,再确认一次避免重复加载
+		table.RLock()
+		item, ok := table.items.Get(key)
+		table.RUnlock()
+		if ok {
+			return item, nil
+		}
+		item, err := table.callLoader(loadData, key)
+		if item != nil && !item.skipsCache() {
+			table.Add(item.key, item.lifeSpan, item.data)
+		}
+		return item, err
+	})
+}
+
+// 获取key对应的item,不存在时调用load加载,以lifeSpan存入table后返回
+// 命中时和Value一样会KeepAlive;并发调用同一个key时load只会执行一次,其它调用共享结果
+// load返回错误时不存储任何东西,直接返回它的错误
+func (table *CacheTable) GetOrLoad(key interface{}, lifeSpan time.Duration, load func() (interface{}, error)) (*CacheItem, error) {
+	if item, err := table.ValueOpts(key, NoLoad()); err == nil {
+		return item, nil
+	}
+	return table.loads.do(key, func() (*CacheItem, error) {
+		table.RLock()
+		item, ok := table.items.Get(key)
+		table.RUnlock()
+		if ok {
+			return item, nil
+		}
+		data, err := load()
+		if err != nil {
+			return nil, err
+		}
+		return table.AddWithError(key, lifeSpan, data)
+	})
+}
+
+// 调用loadData并记录耗时,超过慢加载阈值时调用slowLoad
+// 设置了并发上限时先获取信号量,fail fast模式下拿不到时返回ErrLoadConcurrencyExceeded
+func (table *CacheTable) callLoader(loadData func(key interface{}, args ...interface{}) *CacheItem, key interface{}, args ...interface{}) (*CacheItem, error) {
+	table.RLock()
+	sem, failFast := table.loadSem, table.loadFailFast
+	table.RUnlock()
+	if sem != nil {
+		if failFast {
+			select {
+			case sem <- struct{}{}:
+			default:
+				return nil, ErrLoadConcurrencyExceeded
+			}
+		} else {
+			sem <- struct{}{}
+		}
+		defer func() { <-sem }()
+	}
+
+	start := time.Now()
+	item := loadData(key, args...)
+	took := time.Since(start)
+
+	atomic.AddInt64(&table.loadCount, 1)
+	atomic.AddInt64(&table.loadTime, int64(took))
+	for {
+		max := atomic.LoadInt64(&table.maxLoadTime)
+		if int64(took) <= max || atomic.CompareAndSwapInt64(&table.maxLoadTime, max, int64(took)) {
+			break
+		}
+	}
+
+	table.RLock()
+	threshold, slowLoad := table.slowLoadThreshold, table.slowLoad
+	table.RUnlock()
+	if slowLoad != nil && took > threshold {
+		slowLoad(key, took)
+	}
+	return item, nil
+}
+
+// 限制同时执行的loadData数量,n<=0表示不限制
+// 超过上限的调用默认等待空出位置,failFast为true时直接返回ErrLoadConcurrencyExceeded
+func (table *CacheTable) SetMaxConcurrentLoads(n int, failFast bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.loadFailFast = failFast
+	if n <= 0 {
+		table.loadSem = nil
+		return
+	}
+	table.loadSem = make(chan struct{}, n)
+}
+
+// 设置慢加载告警,loadData耗时超过threshold时调用f,f不在锁内调用
+func (table *CacheTable) SetOnSlowLoad(threshold time.Duration, f func(key interface{}, took time.Duration)) {
+	table.Lock()
+	defer table.Unlock()
+	table.slowLoadThreshold = threshold
+	table.slowLoad = f
+}
+
+// 批量读取keys,table中没有的key通过loadData并发加载并写入table,重复的key只会加载一次
+// 和并发的EnsureValues/Value加载同一个key时会共享同一次加载的结果
+// 返回的map中不包含既不在table中也加载不到的key
+func (table *CacheTable) EnsureValues(keys []interface{}) map[interface{}]*CacheItem {
+	r := make(map[interface{}]*CacheItem, len(keys))
+	var missing []interface{}
+	for _, key := range keys {
+		if _, ok := r[key]; ok {
+			continue
+		}
+		if item, err := table.ValueOpts(key, NoLoad()); err == nil {
+			r[key] = item
+		} else {
+			r[key] = nil
+			missing = append(missing, key)
+		}
+	}
+
+	table.RLock()
+	loadData := table.loadData
+	table.RUnlock()
+	// 缺失的key并发加载
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, key := range missing {
+		delete(r, key)
+		if loadData == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(key interface{}) {
+			defer wg.Done()
+			if item, _ := table.load(key, loadData); item != nil {
+				mu.Lock()
+				r[key] = item
+				mu.Unlock()
+			}
+		}(key)
+	}
+	wg.Wait()
+	return r
+}
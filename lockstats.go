@@ -0,0 +1,66 @@
+package cache2go
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// table锁竞争的统计数据
+type LockStats struct {
+	Acquisitions int64         // 加锁次数
+	Contended    int64         // 需要等待才拿到锁的次数
+	WaitTime     time.Duration // 累计等待时间
+}
+
+// 开启/关闭锁竞争统计,默认关闭,关闭时没有额外开销
+func (table *CacheTable) SetLockProfiling(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&table.lockProfiling, v)
+}
+
+// 获取锁竞争统计数据
+func (table *CacheTable) LockStats() LockStats {
+	return LockStats{
+		Acquisitions: atomic.LoadInt64(&table.lockAcquisitions),
+		Contended:    atomic.LoadInt64(&table.lockContended),
+		WaitTime:     time.Duration(atomic.LoadInt64(&table.lockWaitTime)),
+	}
+}
+
+// 覆盖内嵌RWMutex的Lock,开启统计时先TryLock,拿不到锁才算一次竞争并记录等待时间
+func (table *CacheTable) Lock() {
+	if atomic.LoadInt32(&table.lockProfiling) == 0 {
+		table.RWMutex.Lock()
+		return
+	}
+	atomic.AddInt64(&table.lockAcquisitions, 1)
+	if table.RWMutex.TryLock() {
+		return
+	}
+	start := time.Now()
+	table.RWMutex.Lock()
+	table.recordLockWait(start)
+}
+
+// 覆盖内嵌RWMutex的RLock,逻辑同Lock
+func (table *CacheTable) RLock() {
+	if atomic.LoadInt32(&table.lockProfiling) == 0 {
+		table.RWMutex.RLock()
+		return
+	}
+	atomic.AddInt64(&table.lockAcquisitions, 1)
+	if table.RWMutex.TryRLock() {
+		return
+	}
+	start := time.Now()
+	table.RWMutex.RLock()
+	table.recordLockWait(start)
+}
+
+func (table *CacheTable) recordLockWait(start time.Time) {
+	atomic.AddInt64(&table.lockContended, 1)
+	atomic.AddInt64(&table.lockWaitTime, int64(time.Since(start)))
+}
@@ -0,0 +1,64 @@
+package cache2go
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// 日志级别
+type LogLevel int32
+
+const (
+	LogDebug LogLevel = iota // 到期检查之类的调试信息
+	LogInfo                  // 增删改等常规操作
+	LogError                 // 错误
+)
+
+// 设置日志级别,低于level的日志不输出,默认LogDebug即全部输出
+func (table *CacheTable) SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&table.logLevel, int32(level))
+}
+
+func (table *CacheTable) logDebug(v ...interface{}) {
+	table.logAt(LogDebug, v...)
+}
+
+func (table *CacheTable) logInfo(v ...interface{}) {
+	table.logAt(LogInfo, v...)
+}
+
+func (table *CacheTable) logError(v ...interface{}) {
+	table.logAt(LogError, v...)
+}
+
+// 调用方是否持有table的锁都可以,logger和onLogError由logMu单独保护
+func (table *CacheTable) logAt(level LogLevel, v ...interface{}) {
+	table.logMu.RLock()
+	logger, onLogError := table.logger, table.onLogError
+	table.logMu.RUnlock()
+	if logger == nil || level < LogLevel(atomic.LoadInt32(&table.logLevel)) {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			reportLogError(onLogError, fmt.Errorf("cache2go: logger panic: %v", r))
+		}
+	}()
+	if err := logger.Output(3, fmt.Sprintln(v...)); err != nil {
+		reportLogError(onLogError, err)
+	}
+}
+
+// 设置logger写入失败时的回调,logger的panic也会被recover后转成error传给f
+// 日志失败不会影响cache本身的操作,f为nil时直接忽略错误
+func (table *CacheTable) SetOnLogError(f func(err error)) {
+	table.logMu.Lock()
+	defer table.logMu.Unlock()
+	table.onLogError = f
+}
+
+func reportLogError(onLogError func(err error), err error) {
+	if onLogError != nil {
+		onLogError(err)
+	}
+}
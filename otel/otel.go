@@ -0,0 +1,47 @@
+// 把cache2go的table统计数据导出为OpenTelemetry指标,放在单独的module中,核心module不依赖OpenTelemetry
+package otel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"xswwhy/cache2go"
+)
+
+// 在meter上为table注册可观测的指标,每次采集时读取table.Stats():
+// cache2go.items(当前item数量)、cache2go.hits、cache2go.misses、cache2go.evictions(累计次数),都带有table属性
+// 不再需要导出时调用返回值的Unregister
+func RegisterOTel(meter metric.Meter, table *cache2go.CacheTable) (metric.Registration, error) {
+	items, err := meter.Int64ObservableGauge("cache2go.items",
+		metric.WithDescription("Number of items in the table"))
+	if err != nil {
+		return nil, err
+	}
+	hits, err := meter.Int64ObservableCounter("cache2go.hits",
+		metric.WithDescription("Number of Value calls that found the key"))
+	if err != nil {
+		return nil, err
+	}
+	misses, err := meter.Int64ObservableCounter("cache2go.misses",
+		metric.WithDescription("Number of Value calls that missed the key"))
+	if err != nil {
+		return nil, err
+	}
+	evictions, err := meter.Int64ObservableCounter("cache2go.evictions",
+		metric.WithDescription("Number of items evicted by the eviction policy"))
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := metric.WithAttributes(attribute.String("table", table.Config().Name))
+	return meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		s := table.Stats()
+		o.ObserveInt64(items, int64(s.Items), attrs)
+		o.ObserveInt64(hits, s.Hits, attrs)
+		o.ObserveInt64(misses, s.Misses, attrs)
+		o.ObserveInt64(evictions, s.Evictions, attrs)
+		return nil
+	}, items, hits, misses, evictions)
+}
@@ -0,0 +1,68 @@
+package otel
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"xswwhy/cache2go"
+)
+
+func TestRegisterOTel(t *testing.T) {
+	table := cache2go.NewNamespace().Cache("testRegisterOTel")
+	table.SetMaxItems(2)
+	for _, key := range []string{"a", "b", "c"} {
+		table.Add(key, 0, "value")
+	}
+	table.Value("c")
+	table.Value("missing")
+
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("cache2go")
+	reg, err := RegisterOTel(meter, table)
+	if err != nil {
+		t.Fatal("Error registering instruments", err)
+	}
+	defer reg.Unregister()
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal("Error collecting metrics", err)
+	}
+	got := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			var points []metricdata.DataPoint[int64]
+			switch d := m.Data.(type) {
+			case metricdata.Gauge[int64]:
+				points = d.DataPoints
+			case metricdata.Sum[int64]:
+				if !d.IsMonotonic {
+					t.Error("Counter isn't monotonic", m.Name)
+				}
+				points = d.DataPoints
+			}
+			for _, p := range points {
+				if v, ok := p.Attributes.Value(attribute.Key("table")); !ok || v.AsString() != "testRegisterOTel" {
+					t.Error("Missing table attribute", m.Name)
+				}
+				got[m.Name] = p.Value
+			}
+		}
+	}
+
+	want := map[string]int64{
+		"cache2go.items":     2,
+		"cache2go.hits":      1,
+		"cache2go.misses":    1,
+		"cache2go.evictions": 1,
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Error("Expected", name, "to be", v, "got", got[name])
+		}
+	}
+}
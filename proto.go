@@ -0,0 +1,86 @@
+package cache2go
+
+import (
+	"sort"
+	"time"
+)
+
+// 可以直接映射成protobuf消息的item,所有字段都是protobuf的标量类型
+// key和data由调用方提供的函数编码为字节,并附带类型标记,方便导入时解码
+type ItemProto struct {
+	Key                   []byte
+	KeyType               string
+	Data                  []byte
+	DataType              string
+	LifeSpanNanos         int64 // 空闲时间上限
+	AbsoluteLifeSpanNanos int64 // 绝对存活时间上限
+	CreatedOnUnixNano     int64
+	AccessedOnUnixNano    int64
+	AccessCount           int64
+}
+
+// 把table中的item导出为ItemProto,按key排序,marshal负责把key和data编码为字节和类型标记
+// 导出不会更新item的访问时间
+func (table *CacheTable) ExportProto(marshal func(v interface{}) ([]byte, string)) []*ItemProto {
+	table.RLock()
+	items := table.allItems()
+	table.RUnlock()
+	sort.Slice(items, func(i, j int) bool {
+		return keyLess(items[i].key, items[j].key)
+	})
+
+	r := make([]*ItemProto, 0, len(items))
+	for _, item := range items {
+		item.RWMutex.RLock()
+		p := &ItemProto{
+			LifeSpanNanos:         int64(item.lifeSpan),
+			AbsoluteLifeSpanNanos: int64(item.absoluteLifeSpan),
+			CreatedOnUnixNano:     item.createdOn.UnixNano(),
+			AccessedOnUnixNano:    item.accessedOn.UnixNano(),
+			AccessCount:           item.accessCount,
+		}
+		data := item.data
+		item.RWMutex.RUnlock()
+		p.Key, p.KeyType = marshal(item.key)
+		p.Data, p.DataType = marshal(data)
+		r = append(r, p)
+	}
+	return r
+}
+
+// 导入ExportProto导出的item,保留到期时间、时间戳和访问次数,unmarshal按类型标记解码key和data
+// 任何一个item解码失败或者table不可写时返回错误,不导入任何item;被onWrite拒绝的item跳过,导入其它item后返回第一个错误
+func (table *CacheTable) ImportProto(protos []*ItemProto, unmarshal func(b []byte, typ string) (interface{}, error)) error {
+	items := make([]*CacheItem, 0, len(protos))
+	for _, p := range protos {
+		key, err := unmarshal(p.Key, p.KeyType)
+		if err != nil {
+			return err
+		}
+		data, err := unmarshal(p.Data, p.DataType)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		item := newCacheItemAt(key, time.Duration(p.LifeSpanNanos), data, notAfter(time.Unix(0, p.CreatedOnUnixNano), now))
+		item.absoluteLifeSpan = time.Duration(p.AbsoluteLifeSpanNanos)
+		item.accessedOn = notAfter(time.Unix(0, p.AccessedOnUnixNano), now)
+		item.accessCount = p.AccessCount
+		items = append(items, item)
+	}
+
+	table.touch()
+	table.RLock()
+	err := table.writable()
+	table.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		table.Lock()
+		if e := table.addInternal(item); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package cache2go
+
+// table的只读视图,只暴露查询方法,用于把table交给只能读不能写的模块
+type ReadOnlyTable struct {
+	table *CacheTable
+}
+
+// 获取table的只读视图,读到的始终是table的最新内容
+func (table *CacheTable) ReadOnly() *ReadOnlyTable {
+	return &ReadOnlyTable{table: table}
+}
+
+// 同CacheTable.Value
+func (r *ReadOnlyTable) Value(key interface{}, args ...interface{}) (*CacheItem, error) {
+	return r.table.Value(key, args...)
+}
+
+// 同CacheTable.Peek
+func (r *ReadOnlyTable) Peek(key interface{}) (*CacheItem, error) {
+	return r.table.Peek(key)
+}
+
+// 同CacheTable.Exists
+func (r *ReadOnlyTable) Exists(key interface{}) bool {
+	return r.table.Exists(key)
+}
+
+// 同CacheTable.Count
+func (r *ReadOnlyTable) Count() int {
+	return r.table.Count()
+}
+
+// 同CacheTable.Keys
+func (r *ReadOnlyTable) Keys() []interface{} {
+	return r.table.Keys()
+}
+
+// 持有读锁遍历table中的item,trans中不能修改table
+func (r *ReadOnlyTable) Foreach(trans func(key interface{}, item *CacheItem)) {
+	r.table.RLock()
+	defer r.table.RUnlock()
+	r.table.items.Range(func(k interface{}, v *CacheItem) bool {
+		trans(k, v)
+		return true
+	})
+}
@@ -0,0 +1,43 @@
+package cache2go
+
+import "time"
+
+// 定时器,Stop的语义和time.Timer.Stop一致
+type Timer interface {
+	Stop() bool
+}
+
+// 定时任务的调度器,到期检查和延迟删除都通过它设置定时器,默认使用time.AfterFunc
+// 测试时可以换成手动触发的实现,不用sleep就能确定地驱动到期检查
+type Scheduler interface {
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// 基于time包的默认调度器
+type realScheduler struct{}
+
+func (realScheduler) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// 设置table的调度器,nil表示恢复默认;已经设置的到期检查定时器会取消,并用新的调度器重新安排
+// 时间轮(SetExpirationWheel)使用自己的ticker,不受调度器影响
+func (table *CacheTable) SetScheduler(s Scheduler) {
+	table.Lock()
+	if table.cleanupTimer != nil {
+		table.cleanupTimer.Stop()
+		table.cleanupTimer = nil
+	}
+	table.scheduler = s
+	table.cleanupInterval = 0
+	table.Unlock()
+	table.expirationCheck()
+}
+
+// 通过table的调度器设置定时器,调用方需持有锁
+func (table *CacheTable) afterFunc(d time.Duration, f func()) Timer {
+	if table.scheduler == nil {
+		return realScheduler{}.AfterFunc(d, f)
+	}
+	return table.scheduler.AfterFunc(d, f)
+}
@@ -0,0 +1,64 @@
+package cache2go
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// 前缀和key之间的分隔符
+const scopeSeparator = ":"
+
+// table中以某个前缀划分出来的子视图,不同模块共用一个table时用来隔离各自的key
+// 底层key为 prefix + ":" + key,Keys返回时去掉前缀;前缀中不应包含分隔符,否则可能和嵌套的Scope冲突
+type ScopedTable struct {
+	table  *CacheTable
+	prefix string
+}
+
+// 获取前缀为prefix的子视图
+func (table *CacheTable) Scope(prefix string) *ScopedTable {
+	return &ScopedTable{table: table, prefix: prefix + scopeSeparator}
+}
+
+// 在当前子视图下再划分一层
+func (s *ScopedTable) Scope(prefix string) *ScopedTable {
+	return &ScopedTable{table: s.table, prefix: s.prefix + prefix + scopeSeparator}
+}
+
+// 获取底层table中的key
+func (s *ScopedTable) fullKey(key string) string {
+	return s.prefix + key
+}
+
+// 同CacheTable.Add,key会加上前缀
+func (s *ScopedTable) Add(key string, lifeSpan time.Duration, data interface{}) *CacheItem {
+	return s.table.Add(s.fullKey(key), lifeSpan, data)
+}
+
+// 同CacheTable.Value,key会加上前缀
+func (s *ScopedTable) Value(key string, args ...interface{}) (*CacheItem, error) {
+	return s.table.Value(s.fullKey(key), args...)
+}
+
+// 同CacheTable.Delete,key会加上前缀
+func (s *ScopedTable) Delete(key string) (*CacheItem, error) {
+	return s.table.Delete(s.fullKey(key))
+}
+
+// 同CacheTable.Exists,key会加上前缀
+func (s *ScopedTable) Exists(key string) bool {
+	return s.table.Exists(s.fullKey(key))
+}
+
+// 获取子视图中所有的key,已经去掉前缀,按字母序排列
+func (s *ScopedTable) Keys() []string {
+	var r []string
+	for _, k := range s.table.Keys() {
+		if str, ok := k.(string); ok && strings.HasPrefix(str, s.prefix) {
+			r = append(r, strings.TrimPrefix(str, s.prefix))
+		}
+	}
+	sort.Strings(r)
+	return r
+}
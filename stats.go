@@ -0,0 +1,78 @@
+package cache2go
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// table的统计数据
+type TableStats struct {
+	Items  int   // 当前item数量
+	Hits   int64 // Value命中次数
+	Misses int64 // Value未命中次数(包括通过loadData加载成功的)
+	// Value遇到已经到期但还没被清理的item的次数,持续增长说明lifeSpan和到期检查的节奏不匹配
+	StaleHits int64
+	Evictions int64 // 按淘汰策略(SetMaxItems、SetMaxCost)淘汰的item数量
+
+	LastCleanupDuration time.Duration // 最近一次到期检查的耗时
+	MaxCleanupDuration  time.Duration // 历史最长的到期检查耗时
+
+	Loads       int64         // loadData的调用次数
+	LoadTime    time.Duration // loadData的累计耗时
+	MaxLoadTime time.Duration // loadData的最长耗时
+}
+
+// 获取table的统计数据
+func (table *CacheTable) Stats() TableStats {
+	table.RLock()
+	defer table.RUnlock()
+	return TableStats{
+		Items:               table.items.Len(),
+		Hits:                atomic.LoadInt64(&table.hits),
+		Misses:              atomic.LoadInt64(&table.misses),
+		StaleHits:           atomic.LoadInt64(&table.staleHits),
+		Evictions:           atomic.LoadInt64(&table.evictions),
+		LastCleanupDuration: table.lastCleanupDuration,
+		MaxCleanupDuration:  table.maxCleanupDuration,
+		Loads:               atomic.LoadInt64(&table.loadCount),
+		LoadTime:            time.Duration(atomic.LoadInt64(&table.loadTime)),
+		MaxLoadTime:         time.Duration(atomic.LoadInt64(&table.maxLoadTime)),
+	}
+}
+
+// 获取默认Namespace中所有table的统计数据,以及所有table的汇总
+func GlobalStats() (map[string]TableStats, TableStats) {
+	return defaultNamespace.Stats()
+}
+
+// 获取ns中所有table的统计数据,以及所有table的汇总
+func (ns *Namespace) Stats() (map[string]TableStats, TableStats) {
+	// 先拷贝一份table列表就释放锁,统计各个table时不持有ns的锁,避免table之间互相影响
+	ns.mutex.RLock()
+	tables := make(map[string]*CacheTable, len(ns.tables))
+	for _, t := range ns.tables {
+		tables[t.name] = t
+	}
+	ns.mutex.RUnlock()
+
+	r := make(map[string]TableStats, len(tables))
+	var total TableStats
+	for name, t := range tables {
+		s := t.Stats()
+		r[name] = s
+		total.Items += s.Items
+		total.Hits += s.Hits
+		total.Misses += s.Misses
+		total.StaleHits += s.StaleHits
+		total.Evictions += s.Evictions
+		if s.MaxCleanupDuration > total.MaxCleanupDuration {
+			total.MaxCleanupDuration = s.MaxCleanupDuration
+		}
+		total.Loads += s.Loads
+		total.LoadTime += s.LoadTime
+		if s.MaxLoadTime > total.MaxLoadTime {
+			total.MaxLoadTime = s.MaxLoadTime
+		}
+	}
+	return r, total
+}
@@ -0,0 +1,65 @@
+package cache2go
+
+// table存储item的后端,CacheTable内部只通过这个接口访问item
+// 调用方负责加锁,实现不需要考虑并发安全
+type itemStore interface {
+	Get(key interface{}) (*CacheItem, bool)
+	Set(key interface{}, item *CacheItem)
+	Delete(key interface{})
+	// 遍历所有item,f返回false时停止;遍历期间不能修改store
+	Range(f func(key interface{}, item *CacheItem) bool)
+	Len() int
+}
+
+// 默认的store,就是一个普通的map
+type mapStore map[interface{}]*CacheItem
+
+func newMapStore() mapStore {
+	return make(mapStore)
+}
+
+func (m mapStore) Get(key interface{}) (*CacheItem, bool) {
+	item, ok := m[key]
+	return item, ok
+}
+
+func (m mapStore) Set(key interface{}, item *CacheItem) {
+	m[key] = item
+}
+
+func (m mapStore) Delete(key interface{}) {
+	delete(m, key)
+}
+
+func (m mapStore) Range(f func(key interface{}, item *CacheItem) bool) {
+	for k, v := range m {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (m mapStore) Len() int {
+	return len(m)
+}
+
+// 把所有item拷贝到一个slice中,拷贝之后可以边遍历边修改store,调用方需持有锁
+func (table *CacheTable) allItems() []*CacheItem {
+	r := make([]*CacheItem, 0, table.items.Len())
+	table.items.Range(func(_ interface{}, item *CacheItem) bool {
+		r = append(r, item)
+		return true
+	})
+	return r
+}
+
+// 替换table的store,供测试注入统计或者故障用,现有的item会被拷贝到新的store中
+func (table *CacheTable) setStore(s itemStore) {
+	table.Lock()
+	defer table.Unlock()
+	table.items.Range(func(key interface{}, item *CacheItem) bool {
+		s.Set(key, item)
+		return true
+	})
+	table.items = s
+}
@@ -0,0 +1,86 @@
+package cache2go
+
+import "sync"
+
+// 近似的访问次数top-k统计,用Space-Saving算法在每次Value命中时增量更新,不需要像MostAccessed那样每次重新排序
+// 只跟踪2k个计数器:计数器满了以后新出现的key会顶替计数最小的那个,并继承它的计数,所以计数可能偏大
+// 真实访问次数超过总访问次数/2k的key一定会被跟踪到;key被删除后仍然保留计数
+type TopKTracker struct {
+	table *CacheTable
+	k     int
+
+	mu      sync.Mutex
+	entries []CacheItemPair     // 按计数从大到小排列
+	index   map[interface{}]int // key在entries中的位置
+}
+
+// 创建并开始一个跟踪访问次数最多的k个key的TopKTracker,k<=0时返回nil
+// 只统计开始跟踪之后通过Value命中的访问,不需要时用Stop停止
+func (table *CacheTable) TopKTracker(k int) *TopKTracker {
+	if k <= 0 {
+		return nil
+	}
+	t := &TopKTracker{
+		table:   table,
+		k:       k,
+		entries: make([]CacheItemPair, 0, 2*k),
+		index:   make(map[interface{}]int, 2*k),
+	}
+	table.Lock()
+	defer table.Unlock()
+	table.topK = append(table.topK, t)
+	return t
+}
+
+// 停止跟踪,之后的访问不再计入,已有的结果仍然可以查询
+func (t *TopKTracker) Stop() {
+	t.table.Lock()
+	defer t.table.Unlock()
+	for i, tracker := range t.table.topK {
+		if tracker == t {
+			t.table.topK = append(t.table.topK[:i:i], t.table.topK[i+1:]...)
+			return
+		}
+	}
+}
+
+// 获取访问次数最多的(至多)k个key及其近似访问次数,按次数从大到小排列,复杂度O(k)
+func (t *TopKTracker) TopK() []CacheItemPair {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(t.entries)
+	if n > t.k {
+		n = t.k
+	}
+	r := make([]CacheItemPair, n)
+	copy(r, t.entries[:n])
+	return r
+}
+
+// 记录一次访问
+func (t *TopKTracker) record(key interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i, ok := t.index[key]
+	switch {
+	case ok:
+		t.entries[i].AccessCount++
+	case len(t.entries) < cap(t.entries):
+		i = len(t.entries)
+		t.entries = append(t.entries, CacheItemPair{Key: key, AccessCount: 1})
+		t.index[key] = i
+	default:
+		// 顶替计数最小的key
+		i = len(t.entries) - 1
+		delete(t.index, t.entries[i].Key)
+		t.entries[i] = CacheItemPair{Key: key, AccessCount: t.entries[i].AccessCount + 1}
+		t.index[key] = i
+	}
+	// 计数加1之后往前移动,保持从大到小的顺序
+	for i > 0 && t.entries[i-1].AccessCount < t.entries[i].AccessCount {
+		t.entries[i-1], t.entries[i] = t.entries[i], t.entries[i-1]
+		t.index[t.entries[i].Key] = i
+		t.index[t.entries[i-1].Key] = i - 1
+		i--
+	}
+}
@@ -0,0 +1,207 @@
+package cache2go
+
+import (
+	"reflect"
+	"sort"
+)
+
+// WithTables中传给f的句柄,它的方法假定已经持有这些table的写锁,只能在f里使用
+// 删除、添加回调和依赖的级联删除都推迟到f返回、全部解锁之后执行
+type Tx struct {
+	tables map[*CacheTable]*txTable
+}
+
+// 一个table在事务中的改动
+type txTable struct {
+	deleted    []*CacheItem
+	stored     []*CacheItem
+	dependents []interface{}
+}
+
+// 按统一的顺序给tables加写锁后执行f,f返回后全部解锁,用于需要同时一致地访问多个table的操作(比如在两个table之间移动item)
+// 加锁顺序是按表名排序、表名相同时按地址排序,和MoveWhere一致,所以并发调用不会死锁;重复的table只加一次锁
+// f执行期间持有这些table的写锁,只能通过tx访问这些table,调用table上会加锁的方法(Add、Value、Delete等)会死锁
+// 删除后没有再存进任何一个table的item在解锁前清理;解锁后依次调用删除回调、添加回调,级联删除依赖并按淘汰策略淘汰,
+// 和MoveWhere一样,移到另一个table的item只调用table的删除回调
+func WithTables(tables []*CacheTable, f func(tx *Tx)) {
+	ordered := lockOrder(tables)
+	tx := &Tx{tables: make(map[*CacheTable]*txTable, len(ordered))}
+	for _, t := range ordered {
+		t.touch()
+		t.Lock()
+		tx.tables[t] = &txTable{}
+	}
+	unlocked := false
+	unlock := func() {
+		unlocked = true
+		for i := len(ordered) - 1; i >= 0; i-- {
+			ordered[i].Unlock()
+		}
+	}
+	defer func() {
+		// f panic时也要解锁
+		if !unlocked {
+			unlock()
+		}
+	}()
+	f(tx)
+
+	type pending struct {
+		dropped, moved    []*CacheItem
+		added             []*CacheItem
+		dependents        []interface{}
+		evict             []*CacheItem
+		watermark         func()
+		aboutToDeleteItem []func(item *CacheItem)
+		addedItem         []func(item *CacheItem)
+		deferAdded        bool
+	}
+	after := make([]pending, len(ordered))
+	retired := make(map[*CacheItem]bool)
+	for i, t := range ordered {
+		st := tx.tables[t]
+		// 又存进了事务中某个table的item是被移走了,不清理,也不调用item自己的删除回调
+		var dropped, moved []*CacheItem
+		for _, item := range st.deleted {
+			if tx.holds(item) {
+				moved = append(moved, item)
+			} else if !retired[item] {
+				retired[item] = true
+				t.retire(item)
+				dropped = append(dropped, item)
+			}
+		}
+		// 同一个item可能被Set了多次,或者Set之后又被删除了
+		seen := make(map[*CacheItem]bool, len(st.stored))
+		var added []*CacheItem
+		for _, item := range st.stored {
+			if cur, ok := t.items.Get(item.key); ok && cur == item && !seen[item] {
+				seen[item] = true
+				added = append(added, item)
+			}
+		}
+		after[i] = pending{
+			dropped:           dropped,
+			moved:             moved,
+			added:             added,
+			dependents:        st.dependents,
+			evict:             t.evictionCandidates(nil),
+			watermark:         t.checkHighWatermark(),
+			aboutToDeleteItem: t.aboutToDeleteItem,
+			addedItem:         t.addedItem,
+			deferAdded:        t.deferAddedCallbacks,
+		}
+	}
+	unlock()
+
+	for i, t := range ordered {
+		p := after[i]
+		for _, item := range p.dropped {
+			fireDeleted(p.aboutToDeleteItem, item)
+		}
+		for _, item := range p.moved {
+			for _, callback := range p.aboutToDeleteItem {
+				callback(item)
+			}
+		}
+		for _, item := range p.added {
+			t.fireAdded(p.addedItem, p.deferAdded, item)
+		}
+		t.deleteKeys(p.dependents)
+		t.evict(p.evict)
+		if p.watermark != nil {
+			p.watermark()
+		}
+		if len(p.added) > 0 {
+			t.expirationCheck()
+		}
+	}
+}
+
+// 获取table中的item,不更新访问时间
+func (tx *Tx) Get(table *CacheTable, key interface{}) (*CacheItem, error) {
+	if tx.tables[table] == nil {
+		return nil, ErrTableNotInTx
+	}
+	r, ok := table.items.Get(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return r, nil
+}
+
+// 获取table中item的数量
+func (tx *Tx) Count(table *CacheTable) (int, error) {
+	if tx.tables[table] == nil {
+		return 0, ErrTableNotInTx
+	}
+	return table.items.Len(), nil
+}
+
+// 把item存进table,会经过onWrite;覆盖已有的item时和Add一样级联删除依赖它的key
+// item可以是刚从另一个table中Delete掉的,这样就是在table之间移动item
+func (tx *Tx) Set(table *CacheTable, item *CacheItem) error {
+	st := tx.tables[table]
+	if st == nil {
+		return ErrTableNotInTx
+	}
+	if err := table.writable(); err != nil {
+		return err
+	}
+	if err := table.applyOnWrite(item); err != nil {
+		return err
+	}
+	if old, ok := table.items.Get(item.key); ok && old != item {
+		st.dependents = append(st.dependents, table.deps.takeDependents(item.key)...)
+	}
+	table.storeItem(item)
+	st.stored = append(st.stored, item)
+	return nil
+}
+
+// 从table中删除key,返回被删除的item;item在事务结束前没有再Set进事务中的table时才会被清理
+func (tx *Tx) Delete(table *CacheTable, key interface{}) (*CacheItem, error) {
+	st := tx.tables[table]
+	if st == nil {
+		return nil, ErrTableNotInTx
+	}
+	if err := table.writable(); err != nil {
+		return nil, err
+	}
+	r, ok := table.items.Get(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	st.dependents = append(st.dependents, table.detachItem(r)...)
+	st.deleted = append(st.deleted, r)
+	return r, nil
+}
+
+// item是否还在事务中的某个table里
+func (tx *Tx) holds(item *CacheItem) bool {
+	for t := range tx.tables {
+		if cur, ok := t.items.Get(item.key); ok && cur == item {
+			return true
+		}
+	}
+	return false
+}
+
+// 去掉重复和nil的table,按加锁顺序排序
+func lockOrder(tables []*CacheTable) []*CacheTable {
+	seen := make(map[*CacheTable]bool, len(tables))
+	r := make([]*CacheTable, 0, len(tables))
+	for _, t := range tables {
+		if t != nil && !seen[t] {
+			seen[t] = true
+			r = append(r, t)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].name != r[j].name {
+			return r[i].name < r[j].name
+		}
+		return reflect.ValueOf(r[i]).Pointer() < reflect.ValueOf(r[j]).Pointer()
+	})
+	return r
+}
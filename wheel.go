@@ -0,0 +1,138 @@
+package cache2go
+
+import "time"
+
+// 时间轮:按到期时间把item放进一圈桶里,每隔resolution前进一格,一次处理一整个桶
+// 适合大量短TTL的item,每次只看一个桶而不是扫描所有item
+// item被删除时不从桶里移除,桶被处理时发现item已经不在table中就直接丢掉
+type expirationWheel struct {
+	resolution time.Duration
+	buckets    []map[*CacheItem]struct{}
+	cursor     int       // 最近一次处理的桶
+	lastTick   time.Time // 最近一次前进的时间
+	stop       chan struct{}
+}
+
+func newExpirationWheel(resolution time.Duration, size int, now time.Time) *expirationWheel {
+	w := &expirationWheel{
+		resolution: resolution,
+		buckets:    make([]map[*CacheItem]struct{}, size),
+		lastTick:   now,
+		stop:       make(chan struct{}),
+	}
+	for i := range w.buckets {
+		w.buckets[i] = make(map[*CacheItem]struct{})
+	}
+	return w
+}
+
+// 按剩余时间把item放进桶里,保证桶被处理的时间不早于item的到期时间
+// 超出一圈的item放在最远的桶里,到时候重新计算
+func (w *expirationWheel) schedule(item *CacheItem, remaining time.Duration, now time.Time) {
+	untilDeadline := now.Sub(w.lastTick) + remaining
+	n := int((untilDeadline + w.resolution - 1) / w.resolution)
+	if n < 1 {
+		n = 1
+	}
+	if n >= len(w.buckets) {
+		n = len(w.buckets) - 1
+	}
+	w.buckets[(w.cursor+n)%len(w.buckets)][item] = struct{}{}
+}
+
+// 开启时间轮到期机制,代替默认的定时器扫描,resolution是每格的时间,wheelSize是格数
+// item按桶的粒度到期:实际删除时间比到期时间晚,最多晚一个resolution左右
+// 开启后到期时间被改早的item(SetAccessedOn、SetDeadlineFunc)仍然在原来的桶里,到那时才会被删除
+// resolution<=0或者wheelSize<2时关闭时间轮,恢复定时器扫描
+func (table *CacheTable) SetExpirationWheel(resolution time.Duration, wheelSize int) {
+	table.Lock()
+	if table.wheel != nil {
+		close(table.wheel.stop)
+		table.wheel = nil
+	}
+	if resolution <= 0 || wheelSize < 2 || table.closed {
+		table.Unlock()
+		table.expirationCheck()
+		return
+	}
+
+	if table.cleanupTimer != nil {
+		table.cleanupTimer.Stop()
+	}
+	table.cleanupInterval = 0
+	now := time.Now()
+	w := newExpirationWheel(resolution, wheelSize, now)
+	table.wheel = w
+	for _, item := range table.allItems() {
+		table.scheduleExpiration(item, now)
+	}
+	table.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(resolution)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				table.wheelTick(w)
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// 开启了时间轮时把item放进对应的桶,调用方需持有写锁
+func (table *CacheTable) scheduleExpiration(item *CacheItem, now time.Time) {
+	if table.wheel == nil || table.expirationDisabled || table.lazyExpiration {
+		return
+	}
+	if remaining, ok := item.remaining(now, table.maxAge); ok {
+		table.wheel.schedule(item, remaining, now)
+	}
+}
+
+// 时间轮前进一格,删除桶里已经到期的item,还没到期的(比如被KeepAlive续期了)重新放进对应的桶
+func (table *CacheTable) wheelTick(w *expirationWheel) {
+	table.Lock()
+	if table.wheel != w || table.expirationDisabled || table.lazyExpiration {
+		table.Unlock()
+		return
+	}
+	now := time.Now()
+	w.cursor = (w.cursor + 1) % len(w.buckets)
+	w.lastTick = now
+	bucket := w.buckets[w.cursor]
+	w.buckets[w.cursor] = make(map[*CacheItem]struct{})
+
+	var expired []*CacheItem
+	for item := range bucket {
+		if cur, ok := table.items.Get(item.key); !ok || cur != item {
+			continue
+		}
+		remaining, ok := item.remaining(now, table.maxAge)
+		if !ok {
+			continue
+		}
+		if remaining > 0 {
+			w.schedule(item, remaining, now)
+			continue
+		}
+		if r, err := table.deleteInternal(item.key); err == nil {
+			expired = append(expired, r)
+			if table.graveyard != nil {
+				table.graveyard.bury(r, now)
+			}
+			table.publishExpired(r)
+		}
+	}
+	if len(expired) > 0 {
+		table.logDebug("Expiration wheel removed", len(expired), "items from table", table.name)
+	}
+	batchExpire := table.batchExpire
+	table.Unlock()
+
+	if batchExpire != nil && len(expired) > 0 {
+		batchExpire(expired)
+	}
+}